@@ -7,24 +7,29 @@ import (
 	"github.com/je4/utils/v2/pkg/config"
 	"github.com/je4/utils/v2/pkg/stashconfig"
 	"go.ub.unibas.ch/cloud/certloader/v2/pkg/loader"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/service"
 	"io/fs"
 	"os"
 )
 
 type MediaserverImageConfig struct {
-	LocalAddr               string                `toml:"localaddr"`
-	Instance                string                `toml:"instance"`
-	Domains                 []string              `toml:"domains"`
-	ResolverAddr            string                `toml:"resolveraddr"`
-	ResolverTimeout         config.Duration       `toml:"resolvertimeout"`
-	ResolverNotFoundTimeout config.Duration       `toml:"resolvernotfoundtimeout"`
-	Server                  loader.Config         `toml:"server"`
-	Client                  loader.Config         `toml:"client"`
-	GRPCClient              map[string]string     `toml:"grpcclient"`
-	VFS                     map[string]*vfsrw.VFS `toml:"vfs"`
-	Concurrency             uint32                `toml:"concurrency"`
-	QueueSize               uint32                `toml:"queuesize"`
-	Log                     stashconfig.Config    `toml:"log"`
+	LocalAddr               string                             `toml:"localaddr"`
+	Instance                string                             `toml:"instance"`
+	Domains                 []string                           `toml:"domains"`
+	ResolverAddr            string                             `toml:"resolveraddr"`
+	ResolverTimeout         config.Duration                    `toml:"resolvertimeout"`
+	ResolverNotFoundTimeout config.Duration                    `toml:"resolvernotfoundtimeout"`
+	Server                  loader.Config                      `toml:"server"`
+	Client                  loader.Config                      `toml:"client"`
+	GRPCClient              map[string]string                  `toml:"grpcclient"`
+	VFS                     map[string]*vfsrw.VFS              `toml:"vfs"`
+	Concurrency             uint32                             `toml:"concurrency"`
+	QueueSize               uint32                             `toml:"queuesize"`
+	TempDir                 string                             `toml:"tempdir"`
+	ICCDir                  string                             `toml:"iccdir"`
+	Domain                  map[string]service.DomainConfig    `toml:"domain"`
+	Watermark               map[string]service.WatermarkConfig `toml:"watermark"`
+	Log                     stashconfig.Config                 `toml:"log"`
 }
 
 func LoadMediaserverImageConfig(fSys fs.FS, fp string, conf *MediaserverImageConfig) error {
@@ -10,11 +10,13 @@ import (
 	"go.ub.unibas.ch/cloud/certloader/v2/pkg/loader"
 	"go.ub.unibas.ch/cloud/miniresolver/v2/pkg/resolver"
 	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/configs"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/image"
 	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/service"
 	mediaserverproto "go.ub.unibas.ch/mediaserver/mediaserverproto/v2/pkg/mediaserver/proto"
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -140,7 +142,24 @@ func main() {
 		resolver.DoPing(dbClient, logger)
 	}
 
-	srv, err := service.NewActionService(actionDispatcherClients, conf.Instance, conf.Domains, conf.Concurrency, conf.QueueSize, time.Duration(conf.ResolverNotFoundTimeout), vfs, dbClients, logger)
+	// bundled icc profiles, overridden and extended by the profiles in iccdir
+	iccFS, err := fs.Sub(configs.ICCFS, "icc")
+	if err != nil {
+		logger.Fatal().Err(err).Msg("cannot open bundled icc profiles")
+	}
+	colorProfiles, err := image.LoadColorProfiles(iccFS)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("cannot load bundled icc profiles")
+	}
+	if conf.ICCDir != "" {
+		profiles, err := image.LoadColorProfiles(os.DirFS(conf.ICCDir))
+		if err != nil {
+			logger.Fatal().Err(err).Msgf("cannot load icc profiles from %s", conf.ICCDir)
+		}
+		maps.Copy(colorProfiles, profiles)
+	}
+
+	srv, err := service.NewActionService(actionDispatcherClients, conf.Instance, conf.Domains, conf.Concurrency, conf.QueueSize, time.Duration(conf.ResolverNotFoundTimeout), vfs, dbClients, colorProfiles, conf.Domain, conf.Watermark, conf.TempDir, logger)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("cannot create service")
 	}
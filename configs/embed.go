@@ -4,3 +4,6 @@ import "embed"
 
 //go:embed mediaserverimage.toml
 var ConfigFS embed.FS
+
+//go:embed icc/*.icc
+var ICCFS embed.FS
@@ -0,0 +1,98 @@
+// Package geometry computes target sizes and crop boxes of resize operations.
+// Aspect ratios are compared and scaled as rationals, every backend gets the same pixel sizes.
+package geometry
+
+import (
+	"emperror.dev/errors"
+	"math/big"
+)
+
+// Size is a width and height in pixels, 0 is used as wildcard for boxes
+type Size struct {
+	Width  int
+	Height int
+}
+
+// Aspect returns width / height
+func (s Size) Aspect() *big.Rat {
+	return big.NewRat(int64(s.Width), int64(s.Height))
+}
+
+// Contains reports whether o fits into s
+func (s Size) Contains(o Size) bool {
+	return o.Width <= s.Width && o.Height <= s.Height
+}
+
+func (s Size) valid() error {
+	if s.Width <= 0 || s.Height <= 0 {
+		return errors.Errorf("invalid size %dx%d", s.Width, s.Height)
+	}
+	return nil
+}
+
+// Round rounds r to the nearest integer, halves away from zero
+func Round(r *big.Rat) int {
+	num, denom := new(big.Int).Set(r.Num()), r.Denom()
+	// (2 * |num| + denom) / (2 * denom)
+	neg := num.Sign() < 0
+	num.Abs(num)
+	num.Mul(num, big.NewInt(2)).Add(num, denom)
+	num.Quo(num, new(big.Int).Mul(denom, big.NewInt(2)))
+	if neg {
+		num.Neg(num)
+	}
+	return int(num.Int64())
+}
+
+// scaleDim returns v * factor rounded, at least 1
+func scaleDim(v int, factor *big.Rat) int {
+	return max(1, Round(new(big.Rat).Mul(big.NewRat(int64(v), 1), factor)))
+}
+
+// Scale multiplies both dimensions of s by factor, no dimension drops below 1
+func Scale(s Size, factor *big.Rat) (Size, error) {
+	if err := s.valid(); err != nil {
+		return Size{}, err
+	}
+	if factor.Sign() <= 0 {
+		return Size{}, errors.Errorf("invalid scale factor %s", factor.RatString())
+	}
+	return Size{Width: scaleDim(s.Width, factor), Height: scaleDim(s.Height, factor)}, nil
+}
+
+// Fit returns the largest size with the aspect ratio of src within box.
+// A 0 dimension of box is unbounded, the other dimension is then met exactly.
+func Fit(src, box Size) (Size, error) {
+	if err := src.valid(); err != nil {
+		return Size{}, err
+	}
+	if box.Width < 0 || box.Height < 0 || (box.Width == 0 && box.Height == 0) {
+		return Size{}, errors.Errorf("invalid box %dx%d", box.Width, box.Height)
+	}
+	// the width is bound if the source is wider than the box
+	widthBound := box.Height == 0 || (box.Width != 0 && src.Aspect().Cmp(box.Aspect()) >= 0)
+	if widthBound {
+		return Size{Width: box.Width, Height: scaleDim(src.Height, big.NewRat(int64(box.Width), int64(src.Width)))}, nil
+	}
+	return Size{Width: scaleDim(src.Width, big.NewRat(int64(box.Height), int64(src.Height))), Height: box.Height}, nil
+}
+
+// Fill returns the smallest size with the aspect ratio of src which covers box
+func Fill(src, box Size) (Size, error) {
+	if err := src.valid(); err != nil {
+		return Size{}, err
+	}
+	if err := box.valid(); err != nil {
+		return Size{}, errors.Wrap(err, "invalid box")
+	}
+	// the height is bound if the source is wider than the box
+	if src.Aspect().Cmp(box.Aspect()) >= 0 {
+		return Size{Width: scaleDim(src.Width, big.NewRat(int64(box.Height), int64(src.Height))), Height: box.Height}, nil
+	}
+	return Size{Width: box.Width, Height: scaleDim(src.Height, big.NewRat(int64(box.Width), int64(src.Width)))}, nil
+}
+
+// CropBox returns box limited to scaled, rounding may leave a filled size one pixel short
+func CropBox(scaled, box Size) Size {
+	return Size{Width: min(box.Width, scaled.Width), Height: min(box.Height, scaled.Height)}
+}
@@ -0,0 +1,126 @@
+package geometry
+
+import (
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// testSize is a random size for quick.Check, small enough to keep rounding visible
+type testSize Size
+
+func (testSize) Generate(r *rand.Rand, _ int) reflect.Value {
+	return reflect.ValueOf(testSize{Width: 1 + r.Intn(5000), Height: 1 + r.Intn(5000)})
+}
+
+// approx reports whether v is the rounded value of other * num / denom
+func approx(v, other, num, denom int) bool {
+	return v == max(1, Round(big.NewRat(int64(other)*int64(num), int64(denom))))
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		r    *big.Rat
+		want int
+	}{
+		{big.NewRat(1, 2), 1},
+		{big.NewRat(3, 2), 2},
+		{big.NewRat(-1, 2), -1},
+		{big.NewRat(449, 100), 4},
+		{big.NewRat(225, 2), 113},
+		{big.NewRat(7, 1), 7},
+	}
+	for _, tt := range tests {
+		if got := Round(tt.r); got != tt.want {
+			t.Errorf("Round(%s) = %d, want %d", tt.r.RatString(), got, tt.want)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		src, box, want Size
+	}{
+		// integer division took 3:2 for 1:1 and fitted the height
+		{Size{300, 200}, Size{100, 100}, Size{100, 67}},
+		{Size{300, 400}, Size{150, 150}, Size{113, 150}},
+		{Size{400, 200}, Size{100, 0}, Size{100, 50}},
+		{Size{400, 200}, Size{0, 50}, Size{100, 50}},
+		{Size{10000, 1}, Size{100, 100}, Size{100, 1}},
+	}
+	for _, tt := range tests {
+		got, err := Fit(tt.src, tt.box)
+		if err != nil {
+			t.Fatalf("Fit(%v, %v): %v", tt.src, tt.box, err)
+		}
+		if got != tt.want {
+			t.Errorf("Fit(%v, %v) = %v, want %v", tt.src, tt.box, got, tt.want)
+		}
+	}
+	if _, err := Fit(Size{100, 100}, Size{0, 0}); err == nil {
+		t.Error("Fit into 0x0 succeeded")
+	}
+}
+
+func TestFitProperties(t *testing.T) {
+	property := func(src, box testSize) bool {
+		got, err := Fit(Size(src), Size(box))
+		if err != nil {
+			return false
+		}
+		// within the box, one dimension matches and the other follows the aspect ratio of src
+		if !Size(box).Contains(got) {
+			return false
+		}
+		if got.Width == box.Width {
+			return approx(got.Height, src.Height, box.Width, src.Width)
+		}
+		return got.Height == box.Height && approx(got.Width, src.Width, box.Height, src.Height)
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFillProperties(t *testing.T) {
+	property := func(src, box testSize) bool {
+		got, err := Fill(Size(src), Size(box))
+		if err != nil {
+			return false
+		}
+		// covers the box, one dimension matches and the other follows the aspect ratio of src
+		if got.Width == box.Width {
+			if !approx(got.Height, src.Height, box.Width, src.Width) {
+				return false
+			}
+		} else if got.Height != box.Height || !approx(got.Width, src.Width, box.Height, src.Height) {
+			return false
+		}
+		// rounding may lose at most one pixel, the crop box never exceeds the scaled size
+		crop := CropBox(got, Size(box))
+		return got.Contains(crop) && crop.Width >= box.Width-1 && crop.Height >= box.Height-1
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScaleProperties(t *testing.T) {
+	property := func(src testSize, percent uint16) bool {
+		factor := big.NewRat(int64(percent%400)+1, 100)
+		got, err := Scale(Size(src), factor)
+		if err != nil {
+			return false
+		}
+		return approx(got.Width, src.Width, int(factor.Num().Int64()), int(factor.Denom().Int64())) &&
+			approx(got.Height, src.Height, int(factor.Num().Int64()), int(factor.Denom().Int64()))
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+	if _, err := Scale(Size{10, 10}, big.NewRat(0, 1)); err == nil {
+		t.Error("Scale by 0 succeeded")
+	}
+}
@@ -0,0 +1,46 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var colorNames = map[string]color.NRGBA{
+	"white":       {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	"black":       {A: 0xff},
+	"gray":        {R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	"grey":        {R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	"red":         {R: 0xff, A: 0xff},
+	"green":       {G: 0x80, A: 0xff},
+	"blue":        {B: 0xff, A: 0xff},
+	"transparent": {},
+}
+
+var colorRegexp = regexp.MustCompile(`^#?([0-9a-f]{3}|[0-9a-f]{6}|[0-9a-f]{8})$`)
+
+// ParseColor parses a color name or a hex value (#rgb, #rrggbb or #rrggbbaa)
+func ParseColor(str string) (color.NRGBA, error) {
+	str = strings.ToLower(strings.TrimSpace(str))
+	if c, ok := colorNames[str]; ok {
+		return c, nil
+	}
+	parts := colorRegexp.FindStringSubmatch(str)
+	if parts == nil {
+		return color.NRGBA{}, errors.Errorf("invalid color '%s'", str)
+	}
+	hex := parts[1]
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errors.Wrapf(err, "invalid color '%s'", str)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
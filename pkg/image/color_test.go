@@ -0,0 +1,31 @@
+package image
+
+import (
+	"image/color"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := map[string]color.NRGBA{
+		"white":       {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		"transparent": {},
+		"#ff8000":     {R: 0xff, G: 0x80, A: 0xff},
+		"FF800080":    {R: 0xff, G: 0x80, A: 0x80},
+		"#abc":        {R: 0xaa, G: 0xbb, B: 0xcc, A: 0xff},
+	}
+	for str, want := range tests {
+		c, err := ParseColor(str)
+		if err != nil {
+			t.Errorf("%s: %v", str, err)
+			continue
+		}
+		if c != want {
+			t.Errorf("%s: got %v, want %v", str, c, want)
+		}
+	}
+	for _, str := range []string{"", "#12", "chartreuse", "#gggggg"} {
+		if _, err := ParseColor(str); err == nil {
+			t.Errorf("color '%s' succeeded", str)
+		}
+	}
+}
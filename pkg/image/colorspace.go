@@ -0,0 +1,55 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"strings"
+)
+
+// ColorSpace is the target of ConvertColorSpace
+type ColorSpace int
+
+const (
+	ColorSpaceGray ColorSpace = iota
+	// ColorSpaceBitonal has only black and white, tiff stores it with 1 bit per pixel
+	ColorSpaceBitonal
+	ColorSpaceCMYK
+	// ColorSpaceLab is CIE L*a*b* with a D65 white point
+	ColorSpaceLab
+)
+
+var colorSpaceNames = map[string]ColorSpace{
+	"gray":    ColorSpaceGray,
+	"bitonal": ColorSpaceBitonal,
+	"cmyk":    ColorSpaceCMYK,
+	"lab":     ColorSpaceLab,
+}
+
+func (cs ColorSpace) String() string {
+	for name, colorSpace := range colorSpaceNames {
+		if colorSpace == cs {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// ParseColorSpace parses "gray" (or "grey"), "bitonal", "cmyk" or "lab"
+func ParseColorSpace(name string) (ColorSpace, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "grey" {
+		name = "gray"
+	}
+	colorSpace, ok := colorSpaceNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid colour space '%s'", name)
+	}
+	return colorSpace, nil
+}
+
+// checkThreshold returns an error if the bitonal threshold is not within 0 and 1
+func checkThreshold(threshold float64) error {
+	if threshold < 0 || threshold > 1 {
+		return errors.Errorf("threshold %v not >= 0 and <= 1", threshold)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseColorSpace(t *testing.T) {
+	for name, want := range map[string]ColorSpace{"gray": ColorSpaceGray, "Grey": ColorSpaceGray, "bitonal": ColorSpaceBitonal, "cmyk": ColorSpaceCMYK, "lab": ColorSpaceLab} {
+		if colorSpace, err := ParseColorSpace(name); err != nil || colorSpace != want {
+			t.Errorf("%s: got %v, %v, want %v", name, colorSpace, err, want)
+		}
+	}
+	for _, name := range []string{"", "rgb", "hsl"} {
+		if _, err := ParseColorSpace(name); err == nil {
+			t.Errorf("colour space '%s' succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"slices"
+	"strings"
+)
+
+// Depth is the sample depth of an encoded image
+type Depth int
+
+const (
+	// DepthSource keeps the depth of the processed image
+	DepthSource Depth = iota
+	Depth8
+	Depth16
+	// Depth32F stores 32 bit floating point samples
+	Depth32F
+)
+
+var depthNames = map[string]Depth{
+	"8":   Depth8,
+	"16":  Depth16,
+	"32f": Depth32F,
+}
+
+func (d Depth) String() string {
+	for name, depth := range depthNames {
+		if depth == d {
+			return name
+		}
+	}
+	return "source"
+}
+
+// ParseDepth parses "8", "16" or "32f", empty keeps the depth of the source
+func ParseDepth(name string) (Depth, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return DepthSource, nil
+	}
+	depth, ok := depthNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid depth '%s'", name)
+	}
+	return depth, nil
+}
+
+// deepFormats are the formats which store more than 8 bit per sample
+var deepFormats = map[Depth][]string{
+	Depth16:  {"tiff", "tif", "ptif", "png", "jp2", "exr"},
+	Depth32F: {"tiff", "tif", "exr"},
+}
+
+// checkDepth returns an error if format cannot store depth
+func checkDepth(format string, depth Depth) error {
+	if depth == DepthSource || depth == Depth8 {
+		return nil
+	}
+	if !slices.Contains(deepFormats[depth], strings.ToLower(format)) {
+		return errors.Errorf("format %s cannot store depth %s", format, depth)
+	}
+	return nil
+}
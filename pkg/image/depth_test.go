@@ -0,0 +1,16 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseDepth(t *testing.T) {
+	for name, want := range map[string]Depth{"": DepthSource, "8": Depth8, "16": Depth16, "32F": Depth32F} {
+		if depth, err := ParseDepth(name); err != nil || depth != want {
+			t.Errorf("%s: got %v, %v, want %v", name, depth, err, want)
+		}
+	}
+	if _, err := ParseDepth("12"); err == nil {
+		t.Error("depth 12 succeeded")
+	}
+}
@@ -0,0 +1,304 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// exifPeekSize is the number of bytes inspected for exif data, the APP1 segment is limited to 64k
+const exifPeekSize = 64 << 10
+
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// exifTagNames names the tags of ifd0, the exif ifd and the gps ifd which are extracted
+var exifTagNames = map[uint16]string{
+	0x010e: "ImageDescription",
+	0x010f: "Make",
+	0x0110: "Model",
+	0x0112: "Orientation",
+	0x011a: "XResolution",
+	0x011b: "YResolution",
+	0x0128: "ResolutionUnit",
+	0x0131: "Software",
+	0x0132: "DateTime",
+	0x013b: "Artist",
+	0x8298: "Copyright",
+	0x829a: "ExposureTime",
+	0x829d: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x9003: "DateTimeOriginal",
+	0x9004: "DateTimeDigitized",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureBiasValue",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920a: "FocalLength",
+	0x9286: "UserComment",
+	0xa001: "ColorSpace",
+	0xa002: "PixelXDimension",
+	0xa003: "PixelYDimension",
+	0xa405: "FocalLengthIn35mmFilm",
+	0xa430: "CameraOwnerName",
+	0xa431: "BodySerialNumber",
+	0xa433: "LensMake",
+	0xa434: "LensModel",
+	0xa435: "LensSerialNumber",
+}
+
+var gpsTagNames = map[uint16]string{
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+	0x001d: "GPSDateStamp",
+}
+
+// tiffEntry is a single entry of a tiff image file directory
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// tiffTypeSizes holds the byte size of the tiff field types
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// tiffReader reads image file directories of a tiff structure
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiffReader(data []byte) (*tiffReader, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	switch string(data[:4]) {
+	case "II*\x00":
+		return &tiffReader{data: data, order: binary.LittleEndian}, true
+	case "MM\x00*":
+		return &tiffReader{data: data, order: binary.BigEndian}, true
+	}
+	return nil, false
+}
+
+// ifd0 returns the entries of the first image file directory
+func (tr *tiffReader) ifd0() []tiffEntry {
+	return tr.ifd(tr.order.Uint32(tr.data[4:]))
+}
+
+// ifd returns the entries of the directory at offset, truncated entries are skipped
+func (tr *tiffReader) ifd(offset uint32) []tiffEntry {
+	if offset < 8 || uint64(offset)+2 > uint64(len(tr.data)) {
+		return nil
+	}
+	num := int(tr.order.Uint16(tr.data[offset:]))
+	var entries []tiffEntry
+	for i := 0; i < num; i++ {
+		pos := int(offset) + 2 + i*12
+		if pos+12 > len(tr.data) {
+			break
+		}
+		entry := tiffEntry{
+			tag:   tr.order.Uint16(tr.data[pos:]),
+			typ:   tr.order.Uint16(tr.data[pos+2:]),
+			count: tr.order.Uint32(tr.data[pos+4:]),
+		}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = tr.data[pos+8 : pos+8+int(length)]
+		} else {
+			start := uint64(tr.order.Uint32(tr.data[pos+8:]))
+			if start+length > uint64(len(tr.data)) {
+				continue
+			}
+			entry.value = tr.data[start : start+length]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// uint returns the first value of a byte, short or long entry
+func (tr *tiffReader) uint(entry tiffEntry) (uint32, bool) {
+	if entry.count == 0 {
+		return 0, false
+	}
+	switch entry.typ {
+	case 1, 7:
+		return uint32(entry.value[0]), true
+	case 3:
+		return uint32(tr.order.Uint16(entry.value)), true
+	case 4:
+		return tr.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// string formats the value of an entry, multiple values are separated by spaces
+func (tr *tiffReader) string(entry tiffEntry) string {
+	switch entry.typ {
+	case 2:
+		return strings.TrimSpace(strings.TrimRight(string(entry.value), "\x00"))
+	case 7:
+		// undefined, user comments start with an 8 byte character code
+		if entry.tag == 0x9286 && len(entry.value) >= 8 {
+			return strings.TrimSpace(strings.TrimRight(string(entry.value[8:]), "\x00"))
+		}
+		return fmt.Sprintf("%x", entry.value)
+	}
+	var values []string
+	size := int(tiffTypeSizes[entry.typ])
+	for i := 0; i+size <= len(entry.value); i += size {
+		v := entry.value[i:]
+		switch entry.typ {
+		case 1:
+			values = append(values, fmt.Sprint(v[0]))
+		case 6:
+			values = append(values, fmt.Sprint(int8(v[0])))
+		case 3:
+			values = append(values, fmt.Sprint(tr.order.Uint16(v)))
+		case 8:
+			values = append(values, fmt.Sprint(int16(tr.order.Uint16(v))))
+		case 4:
+			values = append(values, fmt.Sprint(tr.order.Uint32(v)))
+		case 9:
+			values = append(values, fmt.Sprint(int32(tr.order.Uint32(v))))
+		case 5:
+			values = append(values, fmt.Sprintf("%d/%d", tr.order.Uint32(v), tr.order.Uint32(v[4:])))
+		case 10:
+			values = append(values, fmt.Sprintf("%d/%d", int32(tr.order.Uint32(v)), int32(tr.order.Uint32(v[4:]))))
+		default:
+			return fmt.Sprintf("%x", entry.value)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// exifTiff returns the tiff structure of exif data in jpeg, tiff or a raw exif blob
+func exifTiff(data []byte) []byte {
+	if bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return jpegSegment(data, 0xe1, "Exif\x00\x00")
+	}
+	return bytes.TrimPrefix(data, []byte("Exif\x00\x00"))
+}
+
+// exifOrientation returns the exif orientation (1-8) of jpeg or tiff data or 1 if there is none
+func exifOrientation(data []byte) int {
+	tr, ok := newTiffReader(exifTiff(data))
+	if !ok {
+		return 1
+	}
+	for _, entry := range tr.ifd0() {
+		if entry.tag != exifTagOrientation {
+			continue
+		}
+		if orientation, ok := tr.uint(entry); ok && orientation >= 1 && orientation <= 8 {
+			return int(orientation)
+		}
+	}
+	return 1
+}
+
+// exifResetOrientation returns a copy of a raw exif blob with the orientation set to 1
+func exifResetOrientation(data []byte) []byte {
+	data = bytes.Clone(data)
+	tr, ok := newTiffReader(exifTiff(data))
+	if !ok {
+		return data
+	}
+	for _, entry := range tr.ifd0() {
+		// the value of a single short is stored within the entry and shares the memory of data
+		if entry.tag == exifTagOrientation && entry.typ == 3 && entry.count == 1 {
+			tr.order.PutUint16(entry.value, 1)
+		}
+	}
+	return data
+}
+
+// parseExif returns the named tags of exif data in jpeg, tiff or a raw exif blob
+func parseExif(data []byte) map[string]string {
+	tr, ok := newTiffReader(exifTiff(data))
+	if !ok {
+		return nil
+	}
+	result := map[string]string{}
+	// visited protects against directories pointing to each other
+	visited := map[uint32]bool{}
+	var collect func(entries []tiffEntry, names map[uint16]string)
+	collect = func(entries []tiffEntry, names map[uint16]string) {
+		for _, entry := range entries {
+			var subNames map[uint16]string
+			switch entry.tag {
+			case exifTagExifIFD:
+				subNames = exifTagNames
+			case exifTagGPSIFD:
+				subNames = gpsTagNames
+			}
+			if subNames != nil {
+				if offset, ok := tr.uint(entry); ok && !visited[offset] {
+					visited[offset] = true
+					collect(tr.ifd(offset), subNames)
+				}
+				continue
+			}
+			if name, ok := names[entry.tag]; ok {
+				if value := tr.string(entry); value != "" {
+					result[name] = value
+				}
+			}
+		}
+	}
+	collect(tr.ifd0(), exifTagNames)
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// jpegSegment returns the content after prefix of the first APPn segment with marker and prefix
+func jpegSegment(data []byte, marker byte, prefix string) []byte {
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			return nil
+		}
+		m := data[pos+1]
+		if m == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		if m == 0xda || m == 0xd9 {
+			// start of scan or end of image, no metadata beyond
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 {
+			return nil
+		}
+		end := min(pos+2+length, len(data))
+		if m == marker && bytes.HasPrefix(data[pos+4:end], []byte(prefix)) {
+			return data[pos+4+len(prefix) : end]
+		}
+		pos += 2 + length
+	}
+	return nil
+}
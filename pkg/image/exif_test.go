@@ -0,0 +1,16 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestExifOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		if got := exifOrientation(orientedJPEG(t, 16, 8, orientation)); got != orientation {
+			t.Errorf("got orientation %d, want %d", got, orientation)
+		}
+	}
+	if got := exifOrientation(fixture(t, 16, 8)); got != 1 {
+		t.Errorf("png without exif has orientation %d", got)
+	}
+}
@@ -0,0 +1,57 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Filter is the resampling filter of a resize
+type Filter int
+
+const (
+	FilterLanczos Filter = iota
+	FilterMitchell
+	// FilterCatrom is the Catmull-Rom spline
+	FilterCatrom
+	// FilterBox averages the covered pixels, it is fast for large reductions
+	FilterBox
+	// FilterNearest keeps hard edges of pixel art and bitonal images
+	FilterNearest
+	FilterTriangle
+)
+
+var filterNames = map[string]Filter{
+	"lanczos":  FilterLanczos,
+	"mitchell": FilterMitchell,
+	"catrom":   FilterCatrom,
+	"box":      FilterBox,
+	"nearest":  FilterNearest,
+	"triangle": FilterTriangle,
+}
+
+// ParseFilter parses "lanczos", "mitchell", "catrom", "box", "nearest" or "triangle", empty is lanczos
+func ParseFilter(name string) (Filter, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return FilterLanczos, nil
+	}
+	filter, ok := filterNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid filter '%s'", name)
+	}
+	return filter, nil
+}
+
+// parseSigma parses the standard deviation of sharpen and blur, it must be finite and greater than 0
+func parseSigma(sigma string) (float64, error) {
+	sig, err := strconv.ParseFloat(sigma, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid sigma '%s'", sigma)
+	}
+	if math.IsNaN(sig) || math.IsInf(sig, 0) || sig <= 0 {
+		return 0, errors.Errorf("sigma %v must be greater than 0", sig)
+	}
+	return sig, nil
+}
@@ -0,0 +1,106 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Gravity anchors an area within an image
+type Gravity int
+
+const (
+	GravityCenter Gravity = iota
+	GravityNorth
+	GravityNorthEast
+	GravityEast
+	GravitySouthEast
+	GravitySouth
+	GravitySouthWest
+	GravityWest
+	GravityNorthWest
+)
+
+var gravityNames = map[string]Gravity{
+	"center":    GravityCenter,
+	"centre":    GravityCenter,
+	"north":     GravityNorth,
+	"northeast": GravityNorthEast,
+	"east":      GravityEast,
+	"southeast": GravitySouthEast,
+	"south":     GravitySouth,
+	"southwest": GravitySouthWest,
+	"west":      GravityWest,
+	"northwest": GravityNorthWest,
+}
+
+// ParseGravity parses a compass direction ("north", "southeast", ...) or "center", empty is center
+func ParseGravity(name string) (Gravity, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return GravityCenter, nil
+	}
+	gravity, ok := gravityNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid gravity '%s'", name)
+	}
+	return gravity, nil
+}
+
+// Position returns the top left corner of an area of width x height placed within outerWidth x outerHeight.
+// margin keeps the area away from the edges it is anchored to.
+func (g Gravity) Position(outerWidth, outerHeight, width, height, margin int) (x, y int) {
+	x = (outerWidth - width) / 2
+	y = (outerHeight - height) / 2
+	switch g {
+	case GravityNorthWest, GravityWest, GravitySouthWest:
+		x = margin
+	case GravityNorthEast, GravityEast, GravitySouthEast:
+		x = outerWidth - width - margin
+	}
+	switch g {
+	case GravityNorthWest, GravityNorth, GravityNorthEast:
+		y = margin
+	case GravitySouthWest, GravitySouth, GravitySouthEast:
+		y = outerHeight - height - margin
+	}
+	return x, y
+}
+
+// CropAnchor selects the area kept by ResizeTypeCrop.
+// With Focus set the area is centred on the focal point FocusX, FocusY (relative, 0-1)
+// as far as the image allows, otherwise it is placed by Gravity.
+type CropAnchor struct {
+	Gravity Gravity
+	Focus   bool
+	FocusX  float64
+	FocusY  float64
+}
+
+var focusRegexp = regexp.MustCompile(`^([0-9.]+),([0-9.]+)$`)
+
+// ParseFocus parses a focal point "x,y" in relative coordinates (0-1)
+func ParseFocus(focus string) (x, y float64, err error) {
+	parts := focusRegexp.FindStringSubmatch(strings.TrimSpace(focus))
+	if parts == nil {
+		return 0, 0, errors.Errorf("invalid focus '%s'", focus)
+	}
+	x, errX := strconv.ParseFloat(parts[1], 64)
+	y, errY := strconv.ParseFloat(parts[2], 64)
+	if errX != nil || errY != nil || x > 1 || y > 1 {
+		return 0, 0, errors.Errorf("focus '%s' not within 0,0 and 1,1", focus)
+	}
+	return x, y, nil
+}
+
+// Position returns the top left corner of the area of width x height within outerWidth x outerHeight
+func (a CropAnchor) Position(outerWidth, outerHeight, width, height int) (x, y int) {
+	if !a.Focus {
+		return a.Gravity.Position(outerWidth, outerHeight, width, height, 0)
+	}
+	x = int(math.Round(a.FocusX*float64(outerWidth) - float64(width)/2))
+	y = int(math.Round(a.FocusY*float64(outerHeight) - float64(height)/2))
+	return max(0, min(x, outerWidth-width)), max(0, min(y, outerHeight-height))
+}
@@ -0,0 +1,32 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestGravity(t *testing.T) {
+	tests := map[string][2]int{
+		"":          {40, 25},
+		"northwest": {5, 5},
+		"north":     {40, 5},
+		"east":      {75, 25},
+		"southeast": {75, 45},
+		"south":     {40, 45},
+	}
+	for name, want := range tests {
+		gravity, err := ParseGravity(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if x, y := gravity.Position(100, 60, 20, 10, 5); x != want[0] || y != want[1] {
+			t.Errorf("%s: got %d,%d, want %d,%d", name, x, y, want[0], want[1])
+		}
+	}
+	if _, err := ParseGravity("up"); err == nil {
+		t.Error("invalid gravity accepted")
+	}
+	if w, h, err := OverlaySize(1000, 500, 200, 100, 0.1); err != nil || w != 100 || h != 50 {
+		t.Errorf("got overlay size %dx%d (%v), want 100x50", w, h, err)
+	}
+}
@@ -0,0 +1,1282 @@
+package image
+
+// conformance tests for the ImageHandler of the current build.
+// run them for every backend:
+//
+//	go test ./pkg/image/
+//	go test -tags imagick ./pkg/image/
+//	go test -tags vips ./pkg/image/
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/binary"
+	"fmt"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/configs"
+	_ "golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testHandler is shared by all tests, libvips cannot be restarted after shutdown
+var testHandler ImageHandler
+
+func TestMain(m *testing.M) {
+	logger := zerolog.Nop()
+	var err error
+	testHandler, err = NewImageHandler("", zLogger.ZLogger(&logger))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot create image handler: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	if err := testHandler.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot close image handler: %v\n", err)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// fixture creates a png image with a colour gradient and a grid, so that
+// every resize and filter operation has some structure to work on
+func fixture(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: 128,
+				A: 255,
+			}
+			if x%16 == 0 || y%16 == 0 {
+				c = color.NRGBA{A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decodeFixture(t *testing.T, handler ImageHandler, width, height int) Image {
+	t.Helper()
+	img, err := handler.Decode(bytes.NewReader(fixture(t, width, height)), int64(width), int64(height), "png", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode %dx%d fixture: %v", width, height, err)
+	}
+	t.Cleanup(func() {
+		_ = img.Close()
+	})
+	return img
+}
+
+// tiffTag returns the short or long value of tag in the first ifd of a tiff
+func tiffTag(t *testing.T, data []byte, tag uint16) (uint32, bool) {
+	t.Helper()
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		t.Fatalf("no tiff")
+	}
+	ifd := int(order.Uint32(data[4:]))
+	entries := int(order.Uint16(data[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := data[ifd+2+i*12:]
+		if order.Uint16(entry) != tag {
+			continue
+		}
+		if order.Uint16(entry[2:]) == 3 {
+			return uint32(order.Uint16(entry[8:])), true
+		}
+		return order.Uint32(entry[8:]), true
+	}
+	return 0, false
+}
+
+func TestDecodeDimension(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 320, 200)
+	if w, h := img.Dimensions(); w != 320 || h != 200 {
+		t.Errorf("got %dx%d, want 320x200", w, h)
+	}
+	if format := img.Format(); format != "png" {
+		t.Errorf("got format %s, want png", format)
+	}
+	if cs := img.ColorSpace(); cs != "srgb" {
+		t.Errorf("got colour space %s, want srgb", cs)
+	}
+	if pages := img.Pages(); pages != 1 {
+		t.Errorf("got %d pages, want 1", pages)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	handler := testHandler
+	if _, err := handler.Decode(bytes.NewReader([]byte("no image data")), 0, 0, "png", 0, 0); err == nil {
+		t.Error("decoding garbage succeeded")
+	}
+}
+
+func TestDecodePage(t *testing.T) {
+	// three frames of red, green and blue
+	palette := color.Palette{
+		color.NRGBA{R: 0xff, A: 0xff},
+		color.NRGBA{G: 0xff, A: 0xff},
+		color.NRGBA{B: 0xff, A: 0xff},
+	}
+	anim := &gif.GIF{}
+	for i := range palette {
+		frame := image.NewPaletted(image.Rect(0, 0, 20, 10), palette)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	handler := testHandler
+	img, err := handler.Decode(bytes.NewReader(buf.Bytes()), 20, 10, "gif", 1, 0)
+	if err != nil {
+		t.Fatalf("cannot decode page 1: %v", err)
+	}
+	defer img.Close()
+	if pages := img.Pages(); pages != 3 {
+		t.Errorf("got %d pages, want 3", pages)
+	}
+	if w, h := img.Dimensions(); w != 20 || h != 10 {
+		t.Errorf("got %dx%d, want 20x10", w, h)
+	}
+	if r, g, b, _ := encodePNG(t, handler, img).At(10, 5).RGBA(); r > 0x1000 || g < 0xf000 || b > 0x1000 {
+		t.Errorf("page 1 is %x,%x,%x, want green", r, g, b)
+	}
+	if _, err := handler.Decode(bytes.NewReader(buf.Bytes()), 20, 10, "gif", 3, 0); !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("page 3 of 3: got %v, want ErrPageNotFound", err)
+	}
+	if _, err := handler.Decode(bytes.NewReader(fixture(t, 20, 10)), 20, 10, "png", 1, 0); !errors.Is(err, ErrPageNotFound) {
+		t.Errorf("page 1 of a png: got %v, want ErrPageNotFound", err)
+	}
+}
+
+func TestAnimation(t *testing.T) {
+	// a red square leaving a trail over white, the later frames only cover the new square
+	palette := color.Palette{color.White, color.NRGBA{R: 0xff, A: 0xff}}
+	anim := &gif.GIF{LoopCount: 3}
+	for i := 0; i < 3; i++ {
+		rect := image.Rect(0, 0, 40, 20)
+		if i > 0 {
+			rect = image.Rect(i*10, 0, i*10+10, 20)
+		}
+		frame := image.NewPaletted(rect, palette)
+		for x := i * 10; x < i*10+10; x++ {
+			for y := 0; y < 20; y++ {
+				frame.SetColorIndex(x, y, 1)
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10*(i+1))
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	anim.Config = image.Config{ColorModel: palette, Width: 40, Height: 20}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	handler := testHandler
+	img, err := handler.Decode(bytes.NewReader(buf.Bytes()), 40, 20, "gif", AllPages, 0)
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("backend: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("cannot decode animation: %v", err)
+	}
+	defer img.Close()
+	if err := handler.Resize(img, "20x10", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, false, FilterNearest); err != nil {
+		t.Fatalf("cannot resize: %v", err)
+	}
+	out := &bytes.Buffer{}
+	if _, _, err := handler.Encode(img, out, "gif", "", 80, DepthSource, "", MetadataKeep); err != nil {
+		t.Fatalf("cannot encode: %v", err)
+	}
+	res, err := gif.DecodeAll(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("cannot decode result: %v", err)
+	}
+	if len(res.Image) != 3 {
+		t.Fatalf("got %d frames, want 3", len(res.Image))
+	}
+	if res.Config.Width != 20 || res.Config.Height != 10 {
+		t.Errorf("got %dx%d, want 20x10", res.Config.Width, res.Config.Height)
+	}
+	if res.LoopCount != 3 {
+		t.Errorf("got loop count %d, want 3", res.LoopCount)
+	}
+	for i, delay := range res.Delay {
+		if delay != 10*(i+1) {
+			t.Errorf("frame %d: got delay %d, want %d", i, delay, 10*(i+1))
+		}
+	}
+	// every frame is resized, the composed last frame shows the trail of all squares
+	last, err := handler.Decode(bytes.NewReader(out.Bytes()), 20, 10, "gif", 2, 0)
+	if err != nil {
+		t.Fatalf("cannot decode last frame: %v", err)
+	}
+	defer last.Close()
+	pixels := encodePNG(t, handler, last)
+	for _, p := range []image.Point{{2, 5}, {12, 5}} {
+		if r, g, _, _ := pixels.At(p.X, p.Y).RGBA(); r < 0xf000 || g > 0x1000 {
+			t.Errorf("last frame at %v is %x,%x, want red", p, r, g)
+		}
+	}
+	if _, g, _, _ := pixels.At(17, 5).RGBA(); g < 0xf000 {
+		t.Errorf("last frame at (17,5) has green %x, want white", g)
+	}
+}
+
+// pdfFixture returns a single page pdf of width x height points filled with red
+func pdfFixture(width, height int) []byte {
+	content := fmt.Sprintf("1 0 0 rg 0 0 %d %d re f", width, height)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents 4 0 R >>", width, height),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestDecodeDensity(t *testing.T) {
+	handler := testHandler
+	for _, tt := range []struct {
+		density               int
+		wantWidth, wantHeight int
+	}{
+		{72, 100, 50},
+		{144, 200, 100},
+	} {
+		img, err := handler.Decode(bytes.NewReader(pdfFixture(100, 50)), 100, 50, "pdf", 0, tt.density)
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("backend: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("density %d: cannot decode: %v", tt.density, err)
+		}
+		if w, h := img.Dimensions(); w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("density %d: got %dx%d, want %dx%d", tt.density, w, h, tt.wantWidth, tt.wantHeight)
+		}
+		_ = img.Close()
+	}
+}
+
+// dngFixture returns an uncompressed 16 bit dng of width x height pixels behind an rggb filter.
+// libraw rejects images smaller than 22 pixels.
+func dngFixture(width, height int) []byte {
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		data     []byte
+	}
+	le := binary.LittleEndian
+	short := func(values ...uint16) []byte {
+		data := make([]byte, 0, 2*len(values))
+		for _, v := range values {
+			data = le.AppendUint16(data, v)
+		}
+		return data
+	}
+	long := func(values ...uint32) []byte {
+		data := make([]byte, 0, 4*len(values))
+		for _, v := range values {
+			data = le.AppendUint32(data, v)
+		}
+		return data
+	}
+	pixels := make([]byte, 0, 2*width*height)
+	for i := 0; i < width*height; i++ {
+		pixels = le.AppendUint16(pixels, 0x4000)
+	}
+	identity := long(1, 1, 0, 1, 0, 1, 0, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 1)
+	entries := []entry{
+		{254, 4, 1, long(0)},
+		{256, 4, 1, long(uint32(width))},
+		{257, 4, 1, long(uint32(height))},
+		{258, 3, 1, short(16)},
+		{259, 3, 1, short(1)},
+		{262, 3, 1, short(32803)},
+		{273, 4, 1, nil}, // strip offset, set below
+		{277, 3, 1, short(1)},
+		{278, 4, 1, long(uint32(height))},
+		{279, 4, 1, long(uint32(len(pixels)))},
+		{284, 3, 1, short(1)},
+		{33421, 3, 2, short(2, 2)},
+		{33422, 1, 4, []byte{0, 1, 1, 2}},
+		{50706, 1, 4, []byte{1, 4, 0, 0}},
+		{50708, 2, 12, []byte("mediaserver\x00")},
+		{50717, 4, 1, long(0xffff)},
+		{50721, 10, 9, identity},
+		{50728, 5, 3, long(1, 1, 1, 1, 1, 1)},
+		{50778, 3, 1, short(21)},
+	}
+	// header, ifd, values which do not fit into an entry, pixels
+	ifdSize := 2 + 12*len(entries) + 4
+	offset := 8 + ifdSize
+	var values []byte
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			offset += len(e.data)
+		}
+	}
+	entries[6].data = long(uint32(offset))
+	buf := append([]byte("II"), short(42)...)
+	buf = append(buf, long(8)...)
+	buf = append(buf, short(uint16(len(entries)))...)
+	for _, e := range entries {
+		buf = append(buf, short(e.tag, e.typ)...)
+		buf = append(buf, long(e.count)...)
+		if len(e.data) > 4 {
+			buf = append(buf, long(uint32(8+ifdSize+len(values)))...)
+			values = append(values, e.data...)
+			continue
+		}
+		buf = append(buf, append(e.data, make([]byte, 4-len(e.data))...)...)
+	}
+	buf = append(buf, long(0)...)
+	buf = append(buf, values...)
+	return append(buf, pixels...)
+}
+
+func TestDecodePagePDF(t *testing.T) {
+	// the page count of a pdf is known after reading a single page
+	handler := testHandler
+	img, err := handler.Decode(bytes.NewReader(pdfFixture(100, 50)), 100, 50, "pdf", 0, 0)
+	if errors.Is(err, ErrNotSupported) {
+		t.Skipf("backend: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+	defer img.Close()
+	if pages := img.Pages(); pages != 1 {
+		t.Errorf("got %d pages, want 1", pages)
+	}
+	if _, err := handler.Decode(bytes.NewReader(pdfFixture(100, 50)), 100, 50, "pdf", 1, 0); err == nil {
+		t.Error("page 1 of 1 succeeded")
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	handler := testHandler
+	develop := func(whiteBalance WhiteBalance) []byte {
+		img, err := handler.DecodeRaw(bytes.NewReader(dngFixture(32, 32)), "dng", whiteBalance, DemosaicAHD, RawColorSpaceSRGB)
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("backend: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("cannot develop: %v", err)
+		}
+		defer img.Close()
+		if w, h := img.Dimensions(); w != 32 || h != 32 {
+			t.Errorf("got %dx%d, want 32x32", w, h)
+		}
+		buf := &bytes.Buffer{}
+		if _, _, err := handler.Encode(img, buf, "png", "", 100, DepthSource, "", MetadataKeep); err != nil {
+			t.Fatalf("cannot encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+	// the same options give the same pixels
+	if !bytes.Equal(develop(WhiteBalanceCamera), develop(WhiteBalanceCamera)) {
+		t.Error("developing twice gives different results")
+	}
+	if _, err := handler.DecodeRaw(bytes.NewReader(fixture(t, 32, 32)), "png", WhiteBalanceCamera, DemosaicAHD, RawColorSpaceSRGB); err == nil {
+		t.Error("developing a png succeeded")
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name                string
+		srcWidth, srcHeight int
+		size                string
+		resizeType          ResizeType
+		wantWidth           int
+		wantHeight          int
+	}{
+		{"aspect landscape", 400, 200, "100x100", ResizeTypeAspect, 100, 50},
+		{"aspect portrait", 300, 400, "150x150", ResizeTypeAspect, 113, 150},
+		{"aspect below 2:1", 300, 200, "100x100", ResizeTypeAspect, 100, 67},
+		{"aspect box wider than image", 300, 200, "400x100", ResizeTypeAspect, 150, 100},
+		{"aspect width only", 400, 200, "100x0", ResizeTypeAspect, 100, 50},
+		{"aspect height only", 400, 200, "0x50", ResizeTypeAspect, 100, 50},
+		{"stretch", 400, 200, "50x70", ResizeTypeStretch, 50, 70},
+		{"crop landscape", 400, 200, "100x100", ResizeTypeCrop, 100, 100},
+		{"crop portrait", 200, 400, "80x60", ResizeTypeCrop, 80, 60},
+		{"crop below 2:1", 300, 200, "100x100", ResizeTypeCrop, 100, 100},
+		{"pad below 2:1", 300, 200, "100x100", ResizeTypePad, 100, 100},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeFixture(t, handler, tt.srcWidth, tt.srcHeight)
+			if err := handler.Resize(img, tt.size, tt.resizeType, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err != nil {
+				t.Fatalf("cannot resize: %v", err)
+			}
+			if w, h := img.Dimensions(); w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("got %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestResizeCropAnchor(t *testing.T) {
+	tests := []struct {
+		name     string
+		anchor   CropAnchor
+		wantHigh bool
+	}{
+		{"center", CropAnchor{}, false},
+		{"west", CropAnchor{Gravity: GravityWest}, false},
+		{"east", CropAnchor{Gravity: GravityEast}, true},
+		{"focus", CropAnchor{Focus: true, FocusX: 0.9, FocusY: 0.5}, true},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeFixture(t, handler, 400, 100)
+			if err := handler.Resize(img, "50x50", ResizeTypeCrop, tt.anchor, color.NRGBA{}, false, FilterLanczos); err != nil {
+				t.Fatalf("cannot resize: %v", err)
+			}
+			if w, h := img.Dimensions(); w != 50 || h != 50 {
+				t.Fatalf("got %dx%d, want 50x50", w, h)
+			}
+			// red grows from left to right, the center crop covers 150-250 of the master
+			r, _, _, _ := encodePNG(t, handler, img).At(25, 27).RGBA()
+			if high := r > 0xb000; high != tt.wantHigh {
+				t.Errorf("got r=%x, want high red %v", r, tt.wantHigh)
+			}
+		})
+	}
+	if _, _, err := ParseFocus("1.5,0"); err == nil {
+		t.Error("focus outside of the image accepted")
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// flat gray with a colourful checkerboard at 300-360, 20-80
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+			if x >= 300 && x < 360 && y >= 20 && y < 80 {
+				c = color.NRGBA{R: 0xff, G: 0x20, B: 0x20, A: 0xff}
+				if (x/4+y/4)%2 == 0 {
+					c = color.NRGBA{R: 0x20, G: 0x20, B: 0xff, A: 0xff}
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	anchor := smartCropAnchor(img, 1, 1)
+	if !anchor.Focus || anchor.FocusX < 0.7 || anchor.FocusX > 0.9 {
+		t.Errorf("got focus %v,%v, want x within 0.7-0.9", anchor.FocusX, anchor.FocusY)
+	}
+	if again := smartCropAnchor(img, 1, 1); again != anchor {
+		t.Errorf("second run got %+v, want %+v", again, anchor)
+	}
+	flat := image.NewGray(image.Rect(0, 0, 400, 100))
+	if anchor := smartCropAnchor(flat, 1, 1); anchor.FocusX != 0.5 || anchor.FocusY != 0.5 {
+		t.Errorf("flat image: got focus %v,%v, want 0.5,0.5", anchor.FocusX, anchor.FocusY)
+	}
+
+	handler := testHandler
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	res, err := handler.Decode(buf, 400, 100, "png", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+	defer res.Close()
+	if err := handler.Resize(res, "50x50", ResizeTypeSmartCrop, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err != nil {
+		t.Fatalf("cannot resize: %v", err)
+	}
+	if w, h := res.Dimensions(); w != 50 || h != 50 {
+		t.Fatalf("got %dx%d, want 50x50", w, h)
+	}
+	// the subject is in the middle of the crop
+	if r, g, b, _ := encodePNG(t, handler, res).At(25, 25).RGBA(); r == g && g == b {
+		t.Errorf("centre of the crop is gray (%x), the subject was cut off", r)
+	}
+}
+
+func TestResizePad(t *testing.T) {
+	tests := []struct {
+		gravity Gravity
+		bgY     int
+		imgY    int
+	}{
+		{GravityCenter, 5, 30},
+		{GravityNorth, 55, 15},
+		{GravitySouth, 5, 45},
+	}
+	handler := testHandler
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.gravity), func(t *testing.T) {
+			img := decodeFixture(t, handler, 100, 50)
+			if err := handler.Resize(img, "60x60", ResizeTypePad, CropAnchor{Gravity: tt.gravity}, red, false, FilterLanczos); err != nil {
+				t.Fatalf("cannot resize: %v", err)
+			}
+			if w, h := img.Dimensions(); w != 60 || h != 60 {
+				t.Fatalf("got %dx%d, want 60x60", w, h)
+			}
+			res := encodePNG(t, handler, img)
+			if r, g, b, _ := res.At(30, tt.bgY).RGBA(); r < 0xf000 || g > 0x1000 || b > 0x1000 {
+				t.Errorf("padding at 30,%d is %x,%x,%x, want red", tt.bgY, r, g, b)
+			}
+			// the fixture has a blue share of one half everywhere
+			if _, _, b, _ := res.At(25, tt.imgY).RGBA(); b < 0x6000 {
+				t.Errorf("image at 25,%d has b=%x, want the fixture", tt.imgY, b)
+			}
+		})
+	}
+	img := decodeFixture(t, handler, 100, 50)
+	if err := handler.Resize(img, "60x0", ResizeTypePad, CropAnchor{}, red, false, FilterLanczos); err == nil {
+		t.Error("pad without height succeeded")
+	}
+}
+
+func TestResizeUpscale(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       string
+		resizeType ResizeType
+		upscale    bool
+		wantWidth  int
+		wantHeight int
+	}{
+		{"aspect", "200x200", ResizeTypeAspect, false, 100, 50},
+		{"aspect upscale", "200x200", ResizeTypeAspect, true, 200, 100},
+		{"stretch", "150x40", ResizeTypeStretch, false, 100, 40},
+		{"crop", "80x80", ResizeTypeCrop, false, 80, 50},
+		{"crop upscale", "80x80", ResizeTypeCrop, true, 80, 80},
+		{"pad", "200x200", ResizeTypePad, false, 200, 200},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeFixture(t, handler, 100, 50)
+			if err := handler.Resize(img, tt.size, tt.resizeType, CropAnchor{}, color.NRGBA{A: 0xff}, tt.upscale, FilterLanczos); err != nil {
+				t.Fatalf("cannot resize: %v", err)
+			}
+			if w, h := img.Dimensions(); w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("got %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestResizeFilter(t *testing.T) {
+	// black and white checkerboard of one pixel squares
+	checker := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				checker.SetGray(x, y, color.Gray{Y: 0xff})
+			}
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, checker); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	handler := testHandler
+	decode := func() Image {
+		img, err := handler.Decode(bytes.NewReader(buf.Bytes()), 64, 64, "png", 0, 0)
+		if err != nil {
+			t.Fatalf("cannot decode: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = img.Close()
+		})
+		return img
+	}
+
+	// nearest neighbour keeps the squares black and white
+	img := decode()
+	if err := handler.Resize(img, "256x256", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, true, FilterNearest); err != nil {
+		t.Fatalf("cannot resize: %v", err)
+	}
+	res := encodePNG(t, handler, img)
+	for _, p := range []image.Point{{1, 1}, {5, 1}, {130, 77}, {254, 3}} {
+		if r, _, _, _ := res.At(p.X, p.Y).RGBA(); r > 0x0800 && r < 0xf800 {
+			t.Errorf("nearest: pixel at %v is %x, want black or white", p, r)
+		}
+	}
+
+	// box averages the squares to gray
+	img = decode()
+	if err := handler.Resize(img, "16x16", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, false, FilterBox); err != nil {
+		t.Fatalf("cannot resize: %v", err)
+	}
+	if r, _, _, _ := encodePNG(t, handler, img).At(8, 8).RGBA(); r < 0x6000 || r > 0xa000 {
+		t.Errorf("box: pixel at 8,8 is %x, want gray", r)
+	}
+
+	if _, err := ParseFilter("sinc"); err == nil {
+		t.Error("unknown filter accepted")
+	}
+}
+
+func TestResizeErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       string
+		resizeType ResizeType
+	}{
+		{"invalid size", "large", ResizeTypeAspect},
+		{"zero size", "0x0", ResizeTypeAspect},
+		{"stretch without height", "100x0", ResizeTypeStretch},
+		{"crop without width", "0x100", ResizeTypeCrop},
+		{"unknown resize type", "100x100", ResizeType(99)},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeFixture(t, handler, 64, 48)
+			if err := handler.Resize(img, tt.size, tt.resizeType, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err == nil {
+				t.Errorf("resize %s succeeded", tt.size)
+			}
+		})
+	}
+}
+
+func TestCrop(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 200, 100)
+	if err := handler.Crop(img, 150, 20, 50, 60); err != nil {
+		t.Fatalf("cannot crop: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 50 || h != 60 {
+		t.Errorf("got %dx%d, want 50x60", w, h)
+	}
+	// the crop must start at 0,0 of the result
+	if err := handler.Crop(img, 0, 0, 50, 60); err != nil {
+		t.Errorf("cannot crop full cropped image: %v", err)
+	}
+	if err := handler.Crop(img, 10, 10, 50, 60); err == nil {
+		t.Error("crop outside of image succeeded")
+	}
+}
+
+// encodePNG encodes img as png and decodes it with the standard library
+func encodePNG(t *testing.T, handler ImageHandler, img Image) image.Image {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if _, _, err := handler.Encode(img, buf, "png", "", 80, DepthSource, "", MetadataKeep); err != nil {
+		t.Fatalf("cannot encode: %v", err)
+	}
+	res, err := png.Decode(buf)
+	if err != nil {
+		t.Fatalf("cannot decode result: %v", err)
+	}
+	return res
+}
+
+func TestRotate(t *testing.T) {
+	tests := []struct {
+		degrees    float64
+		wantWidth  int
+		wantHeight int
+		tolerance  int
+	}{
+		{0, 100, 60, 0},
+		{90, 60, 100, 0},
+		{180, 100, 60, 0},
+		{-90, 60, 100, 0},
+		{450, 60, 100, 0},
+		{45, 114, 114, 1},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v", tt.degrees), func(t *testing.T) {
+			img := decodeFixture(t, handler, 100, 60)
+			if err := handler.Rotate(img, tt.degrees, color.NRGBA{R: 0xff, A: 0xff}); err != nil {
+				t.Fatalf("cannot rotate: %v", err)
+			}
+			w, h := img.Dimensions()
+			if w < tt.wantWidth-tt.tolerance || w > tt.wantWidth+tt.tolerance || h < tt.wantHeight-tt.tolerance || h > tt.wantHeight+tt.tolerance {
+				t.Errorf("got %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestRotateDirection(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 100, 60)
+	if err := handler.Rotate(img, 90, color.NRGBA{A: 0xff}); err != nil {
+		t.Fatalf("cannot rotate: %v", err)
+	}
+	// clockwise: the bottom left corner (low red, high green) moves to the top left
+	r, g, _, _ := encodePNG(t, handler, img).At(5, 5).RGBA()
+	if r > 0x4000 || g < 0xc000 {
+		t.Errorf("top left pixel after rotation is r=%x g=%x, want low red and high green", r, g)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 100, 60)
+	if err := handler.Mirror(img); err != nil {
+		t.Fatalf("cannot mirror: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 100 || h != 60 {
+		t.Errorf("got %dx%d, want 100x60", w, h)
+	}
+	// the red gradient grows from left to right in the fixture
+	r, _, _, _ := encodePNG(t, handler, img).At(5, 5).RGBA()
+	if r < 0xc000 {
+		t.Errorf("left pixel after mirror has r=%x, want high red", r)
+	}
+}
+
+// orientedJPEG creates a jpeg fixture with the given exif orientation
+func orientedJPEG(t *testing.T, width, height, orientation int) []byte {
+	t.Helper()
+	// big endian tiff header with a single ifd entry for the orientation
+	tiff := []byte{'M', 'M', 0, '*', 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, 0, 0, 0, 0}
+	return exifJPEG(t, width, height, tiff)
+}
+
+// exifJPEG creates a jpeg fixture with tiff as exif data
+func exifJPEG(t *testing.T, width, height int, tiff []byte) []byte {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(fixture(t, width, height)))
+	if err != nil {
+		t.Fatalf("cannot decode fixture: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	data := buf.Bytes()
+	res := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}
+	res = append(res, app1...)
+	return append(res, data[2:]...)
+}
+
+func TestComposite(t *testing.T) {
+	handler := testHandler
+	black := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	for i := 3; i < len(black.Pix); i += 4 {
+		black.Pix[i] = 0xff
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, black); err != nil {
+		t.Fatalf("cannot encode overlay: %v", err)
+	}
+	tests := []struct {
+		opacity float64
+		minRed  uint32
+		maxRed  uint32
+	}{
+		{1, 0, 0x1000},
+		{0.5, 0x5000, 0x8000},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v", tt.opacity), func(t *testing.T) {
+			img := decodeFixture(t, handler, 100, 60)
+			overlay, err := handler.Decode(bytes.NewReader(buf.Bytes()), 20, 10, "png", 0, 0)
+			if err != nil {
+				t.Fatalf("cannot decode overlay: %v", err)
+			}
+			defer overlay.Close()
+			x, y := GravitySouthEast.Position(100, 60, 20, 10, 5)
+			if err := handler.Composite(img, overlay, x, y, tt.opacity); err != nil {
+				t.Fatalf("cannot composite: %v", err)
+			}
+			if w, h := img.Dimensions(); w != 100 || h != 60 {
+				t.Errorf("got %dx%d, want 100x60", w, h)
+			}
+			// the overlay covers 75,45 to 95,55, the fixture has much red on the right
+			res := encodePNG(t, handler, img)
+			if r, _, _, _ := res.At(85, 51).RGBA(); r < tt.minRed || r > tt.maxRed {
+				t.Errorf("overlay pixel has r=%x, want %x-%x", r, tt.minRed, tt.maxRed)
+			}
+			if r, _, _, _ := res.At(70, 51).RGBA(); r < 0xa000 {
+				t.Errorf("pixel outside of overlay changed to r=%x", r)
+			}
+		})
+	}
+	img := decodeFixture(t, handler, 10, 10)
+	if err := handler.Composite(img, img, 0, 0, 2); err == nil {
+		t.Error("opacity 2 accepted")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	handler := testHandler
+	img, err := handler.Decode(bytes.NewReader(orientedJPEG(t, 40, 30, 6)), 40, 30, "jpeg", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+	defer img.Close()
+	metadata, err := handler.Metadata(img)
+	if err != nil {
+		t.Fatalf("cannot read metadata: %v", err)
+	}
+	if orientation := metadata.EXIF["Orientation"]; orientation != "6" {
+		t.Errorf("got exif orientation '%s', want 6", orientation)
+	}
+}
+
+func TestMetadataPolicy(t *testing.T) {
+	// ifd0 with orientation 6, artist and a gps ifd at offset 50 holding the latitude reference
+	tiff := []byte{'M', 'M', 0, '*', 0, 0, 0, 8, 0, 3,
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0,
+		0x01, 0x3b, 0, 2, 0, 0, 0, 4, 'A', 'n', 'n', 0,
+		0x88, 0x25, 0, 4, 0, 0, 0, 1, 0, 0, 0, 50,
+		0, 0, 0, 0,
+		0, 1, 0x00, 0x01, 0, 2, 0, 0, 0, 2, 'N', 0, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		policy      string
+		wantArtist  string
+		wantGPS     bool
+		orientation string
+	}{
+		{"keep", "Ann", true, "1"},
+		{"strip", "", false, ""},
+		{"rights-only", "Ann", false, ""},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy, err := ParseMetadataPolicy(tt.policy)
+			if err != nil {
+				t.Fatalf("cannot parse policy: %v", err)
+			}
+			img, err := handler.Decode(bytes.NewReader(exifJPEG(t, 40, 30, tiff)), 40, 30, "jpeg", 0, 0)
+			if err != nil {
+				t.Fatalf("cannot decode: %v", err)
+			}
+			defer img.Close()
+			if err := handler.AutoOrient(img); err != nil {
+				t.Fatalf("cannot auto orient: %v", err)
+			}
+			buf := &bytes.Buffer{}
+			if _, _, err := handler.Encode(img, buf, "jpeg", "", 80, DepthSource, "", policy); err != nil {
+				t.Fatalf("cannot encode: %v", err)
+			}
+			res, err := handler.Decode(buf, 30, 40, "jpeg", 0, 0)
+			if err != nil {
+				t.Fatalf("cannot decode result: %v", err)
+			}
+			defer res.Close()
+			metadata, err := handler.Metadata(res)
+			if err != nil {
+				t.Fatalf("cannot read metadata: %v", err)
+			}
+			if artist := metadata.EXIF["Artist"]; artist != tt.wantArtist {
+				t.Errorf("got artist '%s', want '%s'", artist, tt.wantArtist)
+			}
+			if _, ok := metadata.EXIF["GPSLatitudeRef"]; ok != tt.wantGPS {
+				t.Errorf("got gps %v, want %v", ok, tt.wantGPS)
+			}
+			if orientation := metadata.EXIF["Orientation"]; orientation != tt.orientation {
+				t.Errorf("got orientation '%s', want '%s'", orientation, tt.orientation)
+			}
+			if tt.policy == "rights-only" && !strings.Contains(metadata.XMP, "<rdf:li>Ann</rdf:li>") {
+				t.Errorf("creator missing in xmp: %s", metadata.XMP)
+			}
+		})
+	}
+	if _, err := ParseMetadataPolicy("all"); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
+
+func TestAutoOrient(t *testing.T) {
+	tests := []struct {
+		orientation int
+		wantWidth   int
+		wantHeight  int
+	}{
+		{1, 100, 60},
+		{3, 100, 60},
+		{6, 60, 100},
+		{8, 60, 100},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.orientation), func(t *testing.T) {
+			img, err := handler.Decode(bytes.NewReader(orientedJPEG(t, 100, 60, tt.orientation)), 100, 60, "jpeg", 0, 0)
+			if err != nil {
+				t.Fatalf("cannot decode: %v", err)
+			}
+			defer img.Close()
+			if err := handler.AutoOrient(img); err != nil {
+				t.Fatalf("cannot auto orient: %v", err)
+			}
+			if w, h := img.Dimensions(); w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("got %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+			// the orientation must be reset
+			if err := handler.AutoOrient(img); err != nil {
+				t.Fatalf("cannot auto orient twice: %v", err)
+			}
+			if w, h := img.Dimensions(); w != tt.wantWidth || h != tt.wantHeight {
+				t.Errorf("second auto orient: got %dx%d, want %dx%d", w, h, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
+
+func TestTransformColorProfile(t *testing.T) {
+	srgb, err := fs.ReadFile(configs.ICCFS, "icc/srgb.icc")
+	if err != nil {
+		t.Fatalf("cannot read srgb profile: %v", err)
+	}
+	handler := testHandler
+	img := decodeFixture(t, handler, 64, 48)
+	if err := handler.TransformColorProfile(img, srgb, srgb); err != nil {
+		if errors.Is(err, ErrNotSupported) {
+			t.Skipf("backend: %v", err)
+		}
+		t.Fatalf("cannot transform color profile: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 64 || h != 48 {
+		t.Errorf("got %dx%d, want 64x48", w, h)
+	}
+	if cs := img.ColorSpace(); cs != "srgb" {
+		t.Errorf("got colour space %s, want srgb", cs)
+	}
+	if err := handler.StripColorProfile(img); err != nil {
+		t.Errorf("cannot strip color profile: %v", err)
+	}
+}
+
+func TestFilterKeepsDimension(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 120, 80)
+	if err := handler.Blur(img, "1.5"); err != nil {
+		t.Fatalf("cannot blur: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 120 || h != 80 {
+		t.Errorf("blur: got %dx%d, want 120x80", w, h)
+	}
+	if err := handler.Sharpen(img, "1"); err != nil {
+		t.Fatalf("cannot sharpen: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 120 || h != 80 {
+		t.Errorf("sharpen: got %dx%d, want 120x80", w, h)
+	}
+	// every backend rejects the same sigmas
+	for _, sigma := range []string{"soft", "", "0", "-1", "NaN", "Inf"} {
+		if err := handler.Blur(img, sigma); err == nil {
+			t.Errorf("blur with sigma '%s' succeeded", sigma)
+		}
+		if err := handler.Sharpen(img, sigma); err == nil {
+			t.Errorf("sharpen with sigma '%s' succeeded", sigma)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		format   string
+		compress string
+		mimetype string
+	}{
+		{"jpeg", "", "image/jpeg"},
+		{"png", "", "image/png"},
+		{"tiff", "", "image/tiff"},
+		{"tiff", "no", "image/tiff"},
+		{"tiff", "zip", "image/tiff"},
+	}
+	handler := testHandler
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.compress, func(t *testing.T) {
+			img := decodeFixture(t, handler, 90, 60)
+			buf := &bytes.Buffer{}
+			size, mimetype, err := handler.Encode(img, buf, tt.format, tt.compress, 80, DepthSource, "", MetadataKeep)
+			if err != nil {
+				t.Fatalf("cannot encode: %v", err)
+			}
+			if mimetype != tt.mimetype {
+				t.Errorf("got mimetype %s, want %s", mimetype, tt.mimetype)
+			}
+			if size != uint64(buf.Len()) {
+				t.Errorf("reported size %d, written %d", size, buf.Len())
+			}
+			cfg, _, err := image.DecodeConfig(buf)
+			if err != nil {
+				t.Fatalf("cannot decode result: %v", err)
+			}
+			if cfg.Width != 90 || cfg.Height != 60 {
+				t.Errorf("encoded %dx%d, want 90x60", cfg.Width, cfg.Height)
+			}
+		})
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	handler := testHandler
+	img := decodeFixture(t, handler, 32, 32)
+	if _, _, err := handler.Encode(img, &bytes.Buffer{}, "tiff", "no-such-compression", 80, DepthSource, "", MetadataKeep); err == nil {
+		t.Error("encode with unknown compression succeeded")
+	}
+	if _, _, err := handler.Encode(img, &bytes.Buffer{}, "jp2", "", 80, DepthSource, "tiles", MetadataKeep); err == nil {
+		t.Error("encode with invalid tile succeeded")
+	}
+}
+
+func TestEncodeTiffUncompressed(t *testing.T) {
+	// every backend writes uncompressed tiffs unless a compression is requested
+	for _, format := range []string{"tiff", "tif"} {
+		img := decodeFixture(t, testHandler, 64, 48)
+		out := &bytes.Buffer{}
+		if _, _, err := testHandler.Encode(img, out, format, "", 80, DepthSource, "", MetadataKeep); err != nil {
+			t.Fatalf("cannot encode %s: %v", format, err)
+		}
+		// 259 is Compression, 1 is none
+		if tag, _ := tiffTag(t, out.Bytes(), 259); tag != 1 {
+			t.Errorf("%s without compress has compression %d, want 1", format, tag)
+		}
+	}
+}
+
+func TestEncodeDepth(t *testing.T) {
+	// a 16 bit gradient, its low bytes are lost at 8 bit
+	src := image.NewNRGBA64(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint16(x*1024 + 0x34)
+			src.SetNRGBA64(x, y, color.NRGBA64{R: v, G: v, B: v, A: 0xffff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatalf("cannot encode fixture: %v", err)
+	}
+	handler := testHandler
+	encode := func(depth Depth) image.Image {
+		img, err := handler.Decode(bytes.NewReader(buf.Bytes()), 64, 32, "png", 0, 0)
+		if err != nil {
+			t.Fatalf("cannot decode: %v", err)
+		}
+		defer img.Close()
+		if err := handler.Resize(img, "32x16", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err != nil {
+			t.Fatalf("cannot resize: %v", err)
+		}
+		out := &bytes.Buffer{}
+		if _, _, err := handler.Encode(img, out, "png", "", 100, depth, "", MetadataKeep); err != nil {
+			t.Fatalf("depth %s: cannot encode: %v", depth, err)
+		}
+		res, err := png.Decode(out)
+		if err != nil {
+			t.Fatalf("depth %s: cannot decode result: %v", depth, err)
+		}
+		return res
+	}
+	// a resized 16 bit image has samples which are no multiple of 0x101
+	deep := func(img image.Image) bool {
+		for x := 0; x < 32; x++ {
+			if r, _, _, _ := img.At(x, 8).RGBA(); r%0x101 != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if res := encode(DepthSource); !deep(res) {
+		t.Errorf("depth source: got %T with 8 bit samples, want 16 bit", res)
+	}
+	if res := encode(Depth16); !deep(res) {
+		t.Errorf("depth 16: got %T with 8 bit samples", res)
+	}
+	if res := encode(Depth8); deep(res) {
+		t.Errorf("depth 8: got %T with 16 bit samples", res)
+	}
+	img := decodeFixture(t, handler, 32, 32)
+	defer img.Close()
+	if _, _, err := handler.Encode(img, &bytes.Buffer{}, "jpeg", "", 80, Depth16, "", MetadataKeep); err == nil {
+		t.Error("jpeg with depth 16 succeeded")
+	}
+	if _, _, err := handler.Encode(img, &bytes.Buffer{}, "png", "", 80, Depth32F, "", MetadataKeep); err == nil {
+		t.Error("png with depth 32f succeeded")
+	}
+}
+
+func TestFilterKeepsGray(t *testing.T) {
+	handler := testHandler
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	operations := map[string]func(img Image) error{
+		"sharpen":     func(img Image) error { return handler.Sharpen(img, "1") },
+		"blur":        func(img Image) error { return handler.Blur(img, "1.5") },
+		"rotate 90":   func(img Image) error { return handler.Rotate(img, 90, white) },
+		"rotate 30":   func(img Image) error { return handler.Rotate(img, 30, white) },
+		"mirror":      handler.Mirror,
+		"auto orient": handler.AutoOrient,
+	}
+	masters := map[string]image.Image{
+		"gray":   image.NewGray(image.Rect(0, 0, 48, 32)),
+		"gray16": image.NewGray16(image.Rect(0, 0, 48, 32)),
+	}
+	for masterName, master := range masters {
+		for x := 0; x < 48; x++ {
+			for y := 0; y < 32; y++ {
+				master.(draw.Image).Set(x, y, color.Gray{Y: uint8(x * 5)})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, master); err != nil {
+			t.Fatalf("cannot encode %s master: %v", masterName, err)
+		}
+		for name, operation := range operations {
+			t.Run(masterName+" "+name, func(t *testing.T) {
+				img, err := handler.Decode(bytes.NewReader(buf.Bytes()), 48, 32, "png", 0, 0)
+				if err != nil {
+					t.Fatalf("cannot decode: %v", err)
+				}
+				defer img.Close()
+				if err := operation(img); err != nil {
+					t.Fatalf("cannot %s: %v", name, err)
+				}
+				if colorSpace := img.ColorSpace(); colorSpace != "gray" {
+					t.Errorf("color space is %s, want gray", colorSpace)
+				}
+			})
+		}
+	}
+}
+
+func TestConvertColorSpace(t *testing.T) {
+	handler := testHandler
+	tests := []struct {
+		name       string
+		colorSpace ColorSpace
+		dither     bool
+	}{
+		{"gray", ColorSpaceGray, false},
+		{"bitonal threshold", ColorSpaceBitonal, false},
+		{"bitonal dither", ColorSpaceBitonal, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeFixture(t, handler, 64, 64)
+			err := handler.ConvertColorSpace(img, tt.colorSpace, 0.5, tt.dither)
+			if errors.Is(err, ErrNotSupported) {
+				t.Skipf("backend: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("cannot convert: %v", err)
+			}
+			res := encodePNG(t, handler, img)
+			for y := 0; y < 64; y += 5 {
+				for x := 0; x < 64; x += 5 {
+					r, g, b, _ := res.At(x, y).RGBA()
+					if r != g || g != b {
+						t.Fatalf("(%d,%d) is %x,%x,%x, want gray", x, y, r, g, b)
+					}
+					if tt.colorSpace == ColorSpaceBitonal && r != 0 && r != 0xffff {
+						t.Fatalf("(%d,%d) is %x, want black or white", x, y, r)
+					}
+				}
+			}
+		})
+	}
+	img := decodeFixture(t, handler, 64, 64)
+	if err := handler.ConvertColorSpace(img, ColorSpaceBitonal, 1.5, false); err == nil {
+		t.Error("threshold 1.5 succeeded")
+	}
+	// group4 only compresses bitonal images
+	if _, ok := compresionNames["group4"]; ok {
+		if err := handler.ConvertColorSpace(img, ColorSpaceBitonal, 0.5, false); err != nil {
+			t.Fatalf("cannot convert to bitonal: %v", err)
+		}
+		if _, _, err := handler.Encode(img, &bytes.Buffer{}, "tiff", "group4", 80, DepthSource, "", MetadataKeep); err != nil {
+			t.Errorf("cannot encode group4: %v", err)
+		}
+	}
+}
+
+// foreignImage is an Image which belongs to no backend
+type foreignImage struct{}
+
+func (foreignImage) Dimensions() (int, int) { return 1, 1 }
+func (foreignImage) Format() string         { return "png" }
+func (foreignImage) ColorSpace() string     { return "srgb" }
+func (foreignImage) Pages() int             { return 1 }
+func (foreignImage) Close() error           { return nil }
+
+func TestClose(t *testing.T) {
+	handler := testHandler
+	img, err := handler.Decode(bytes.NewReader(fixture(t, 40, 30)), 40, 30, "png", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatalf("cannot close: %v", err)
+	}
+	if err := img.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+	if w, h := img.Dimensions(); w != 0 || h != 0 {
+		t.Errorf("closed image reports %dx%d", w, h)
+	}
+	if err := handler.Resize(img, "10x10", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err == nil {
+		t.Error("resize of closed image succeeded")
+	}
+	if _, _, err := handler.Encode(img, &bytes.Buffer{}, "png", "", 80, DepthSource, "", MetadataKeep); err == nil {
+		t.Error("encode of closed image succeeded")
+	}
+}
+
+func TestForeignImage(t *testing.T) {
+	handler := testHandler
+	if err := handler.Resize(foreignImage{}, "10x10", ResizeTypeAspect, CropAnchor{}, color.NRGBA{}, false, FilterLanczos); err == nil {
+		t.Error("resize of foreign image succeeded")
+	}
+	if err := handler.Blur(foreignImage{}, "1"); err == nil {
+		t.Error("blur of foreign image succeeded")
+	}
+	if _, _, err := handler.Encode(foreignImage{}, &bytes.Buffer{}, "png", "", 80, DepthSource, "", MetadataKeep); err == nil {
+		t.Error("encode of foreign image succeeded")
+	}
+}
@@ -1,6 +1,20 @@
 package image
 
-import "io"
+import (
+	"emperror.dev/errors"
+	"image/color"
+	"io"
+)
+
+// ErrNotSupported is returned for operations the backend of the current build cannot perform
+var ErrNotSupported = errors.New("not supported by image backend")
+
+// ErrPageNotFound is returned by Decode for a page beyond the pages of the source
+var ErrPageNotFound = errors.New("page not found")
+
+// AllPages makes Decode read all frames of an animation, coalesced to full frames.
+// Operations apply to every frame, Encode writes an animation to gif and webp.
+const AllPages = -1
 
 type ResizeType int
 
@@ -8,15 +22,66 @@ const (
 	ResizeTypeAspect ResizeType = iota
 	ResizeTypeStretch
 	ResizeTypeCrop
+	// ResizeTypeSmartCrop crops like ResizeTypeCrop, the window is chosen by its content
+	ResizeTypeSmartCrop
+	// ResizeTypePad fits the image into the box and fills the remaining area with the background
+	ResizeTypePad
 )
 
+// Image is a decoded image owned by the ImageHandler which created it.
+// Images of one backend cannot be passed to another backend.
+type Image interface {
+	// Dimensions returns the current width and height or 0, 0 after Close
+	Dimensions() (width int, height int)
+	// Format returns the lowercase name of the source format (e.g. "jpeg", "tiff")
+	Format() string
+	// ColorSpace returns the lowercase name of the colour space (e.g. "srgb", "gray", "cmyk")
+	ColorSpace() string
+	// Pages returns the number of pages or frames of the source, only one of them is decoded
+	Pages() int
+	// Close releases all resources. Closing twice is allowed.
+	Close() error
+}
+
 type ImageHandler interface {
-	Decode(in io.Reader, width, height int64, format string) (any, error)
-	Resize(img any, size string, resizeType ResizeType) error
-	Encode(img any, out io.Writer, format, compress string, quality int, tile string) (uint64, string, error)
-	Sharpen(img any, sigmaRadius string) error
-	Blur(img any, sigma string) error
-	Release(img any) error
-	GetDimension(img any) (width int, height int)
+	// Decode reads the page (or frame) with the index page of a multipage source, 0 is the first one, or AllPages.
+	// Vector formats like pdf are rasterised with density dots per inch, 0 keeps the default of the backend.
+	Decode(in io.Reader, width, height int64, format string, page, density int) (Image, error)
+	// DecodeRaw develops a camera raw image of format to 16 bit per channel.
+	// The result depends only on the data and the options, not on defaults of the installation.
+	DecodeRaw(in io.Reader, format string, whiteBalance WhiteBalance, demosaic Demosaic, colorSpace RawColorSpace) (Image, error)
+	// Resize scales the image to size ("<width>x<height>").
+	// anchor places the area kept by ResizeTypeCrop or the image within the box of ResizeTypePad,
+	// background fills the box of ResizeTypePad.
+	// Without upscale the image is never enlarged, crop boxes shrink to the image and pad boxes keep their size.
+	// filter selects the resampling filter.
+	Resize(img Image, size string, resizeType ResizeType, anchor CropAnchor, background color.NRGBA, upscale bool, filter Filter) error
+	// Crop cuts out the area at x, y with width x height pixels
+	Crop(img Image, x, y, width, height int) error
+	// Rotate turns the image clockwise, uncovered areas are filled with background
+	Rotate(img Image, degrees float64, background color.NRGBA) error
+	// Mirror flips the image horizontally
+	Mirror(img Image) error
+	// Composite draws overlay onto img with its top left corner at x, y.
+	// The alpha of overlay is multiplied by opacity (0-1).
+	Composite(img, overlay Image, x, y int, opacity float64) error
+	// AutoOrient applies the exif orientation to the pixels and resets it
+	AutoOrient(img Image) error
+	// TransformColorProfile converts from the embedded icc profile to target and embeds target.
+	// Images without an embedded profile are taken to be in fallback, a nil fallback
+	// leaves the interpretation to the backend.
+	TransformColorProfile(img Image, target, fallback []byte) error
+	// StripColorProfile removes the embedded icc profile
+	StripColorProfile(img Image) error
+	// ConvertColorSpace converts the pixels to colorSpace and removes the embedded icc profile, which no longer fits.
+	// Bitonal images are dithered if dither is set, otherwise luminance below threshold (0-1) becomes black.
+	ConvertColorSpace(img Image, colorSpace ColorSpace, threshold float64, dither bool) error
+	// Metadata returns the embedded exif, iptc, xmp and icc information
+	Metadata(img Image) (*Metadata, error)
+	// Encode writes the image in format, metadata decides which exif, iptc and xmp data is written.
+	// depth converts the samples, deeper than 8 bit is only possible for tiff, png, jp2 and exr.
+	Encode(img Image, out io.Writer, format, compress string, quality int, depth Depth, tile string, metadata MetadataPolicy) (uint64, string, error)
+	Sharpen(img Image, sigmaRadius string) error
+	Blur(img Image, sigma string) error
 	Close() error
 }
@@ -7,8 +7,11 @@ import (
 	"fmt"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"gopkg.in/gographics/imagick.v3/imagick"
+	"image"
+	"image/color"
 	"io"
 	"math"
+	"os"
 	"regexp"
 	"slices"
 	"strconv"
@@ -17,48 +20,138 @@ import (
 
 type imagickImage struct {
 	mw *imagick.MagickWand
+	// pages is the number of pages of the source, mw holds one of them
+	pages int
 }
 
-func NewImageHandler(logger zLogger.ZLogger) ImageHandler {
+func (img *imagickImage) Dimensions() (int, int) {
+	if img.mw == nil {
+		return 0, 0
+	}
+	return int(img.mw.GetImageWidth()), int(img.mw.GetImageHeight())
+}
+
+func (img *imagickImage) Format() string {
+	if img.mw == nil {
+		return ""
+	}
+	return strings.ToLower(img.mw.GetImageFormat())
+}
+
+func (img *imagickImage) ColorSpace() string {
+	if img.mw == nil {
+		return ""
+	}
+	name, ok := colorspaceNames[img.mw.GetImageColorspace()]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+func (img *imagickImage) Pages() int {
+	if img.mw == nil {
+		return 0
+	}
+	return img.pages
+}
+
+// eachFrame calls f with every frame of an animation as current image or once for a single image.
+// The first frame is current afterwards.
+func (img *imagickImage) eachFrame(f func() error) error {
+	if img.mw.GetNumberImages() <= 1 {
+		return f()
+	}
+	defer img.mw.ResetIterator()
+	img.mw.ResetIterator()
+	for img.mw.NextImage() {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (img *imagickImage) Close() error {
+	if img.mw == nil {
+		return nil
+	}
+	img.mw.Destroy()
+	img.mw = nil
+	return nil
+}
+
+// NewImageHandler creates an ImageMagick based handler.
+// Image data is spooled through temporary files in tempDir, os.TempDir() is used if empty.
+// The postscript coders of ghostscript are disabled by a policy in tempDir,
+// the handler is not created if the policy cannot be installed.
+func NewImageHandler(tempDir string, logger zLogger.ZLogger) (ImageHandler, error) {
+	_logger := logger.With().Str("class", "imagickImageHandler").Logger()
+	policyDir, err := installPolicy(tempDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot install imagemagick policy")
+	}
 	imagick.Initialize()
 	mw := imagick.NewMagickWand()
 	defer mw.Destroy()
 	imageFormats = mw.QueryFormats("*")
-	_logger := logger.With().Str("class", "imagickImageHandler").Logger()
 	_logger.Debug().Msgf("supported formats: %s", strings.Join(imageFormats, ", "))
 	return &imagickImageHandler{
-		logger: zLogger.ZLogger(&_logger),
-	}
+		tempDir:   tempDir,
+		policyDir: policyDir,
+		libraw:    slices.Contains(strings.Fields(imagick.GetDelegates()), "raw"),
+		logger:    zLogger.ZLogger(&_logger),
+	}, nil
 }
 
 type imagickImageHandler struct {
+	tempDir   string
+	policyDir string
+	// libraw is set if imagemagick develops camera raw images itself instead of calling an external delegate
+	libraw bool
 	logger zLogger.ZLogger
 }
 
 func (ni *imagickImageHandler) Close() error {
 	imagick.Terminate()
+	if ni.policyDir != "" {
+		if err := os.RemoveAll(ni.policyDir); err != nil {
+			return errors.Wrapf(err, "cannot remove policy directory %s", ni.policyDir)
+		}
+	}
 	return nil
 }
 
-func (ni *imagickImageHandler) Decode(in io.Reader, width, height int64, format string) (any, error) {
+func (ni *imagickImageHandler) Decode(in io.Reader, width, height int64, format string, page, density int) (Image, error) {
 	if !slices.Contains(imageFormats, strings.ToUpper(format)) {
-		return nil, errors.Errorf("unsupported format '%s'", format)
+		return nil, errors.Wrapf(ErrNotSupported, "format '%s'", format)
+	}
+	// imagemagick reads from the spooled file and keeps only the pixel cache in memory
+	name, cleanup, err := spoolFile(in, ni.tempDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot spool image data")
 	}
+	defer cleanup()
 	res := &imagickImage{
 		mw: imagick.NewMagickWand(),
 	}
-	data, err := io.ReadAll(in)
-	if err != nil {
-		res.mw.Destroy()
-		return nil, errors.Wrap(err, "cannot read image data")
+	// the resolution has to be known before reading, it only affects vector formats
+	if density > 0 {
+		if err := res.mw.SetResolution(float64(density), float64(density)); err != nil {
+			res.mw.Destroy()
+			return nil, errors.Wrapf(err, "cannot set density %d", density)
+		}
 	}
-	if err := res.mw.ReadImageBlob(data); err != nil {
+	read := res.readPage
+	if slices.Contains(ghostscriptFormats, strings.ToUpper(format)) {
+		read = res.readDocument
+	}
+	if err := read(name, page); err != nil {
 		res.mw.Destroy()
-		return nil, errors.Wrap(err, "cannot read image")
+		return nil, err
 	}
 	res.mw.SetSize(uint(width), uint(height))
 	res.mw.SetFormat(strings.ToUpper(format))
-	data = nil
 	format = res.mw.GetFormat()
 	descr, ok := imageFormatDescription[strings.ToUpper(format)]
 	if !ok {
@@ -69,133 +162,570 @@ func (ni *imagickImageHandler) Decode(in io.Reader, width, height int64, format
 	return res, nil
 }
 
-func (ni *imagickImageHandler) Sharpen(img any, sigma string) error {
-	nImg, ok := img.(*imagickImage)
-	if !ok {
-		return errors.Errorf("cannot convert %T to *imagickImage", img)
+// readPage counts the pages of name without decoding them, then reads only page or every page for AllPages
+func (img *imagickImage) readPage(name string, page int) error {
+	ping := imagick.NewMagickWand()
+	if err := ping.PingImage(name); err != nil {
+		ping.Destroy()
+		return errors.Wrapf(err, "cannot read image from %s", name)
 	}
-	sig, err := strconv.ParseFloat(sigma, 64)
-	if err != nil {
-		return errors.Wrapf(err, "invalid sigma '%s'", sigma)
+	img.pages = int(ping.GetNumberImages())
+	animation := slices.Contains([]string{"GIF", "WEBP"}, ping.GetImageFormat())
+	ping.Destroy()
+	if page != AllPages && (page < 0 || page >= img.pages) {
+		return errors.Wrapf(ErrPageNotFound, "page %d of %d", page, img.pages)
 	}
-	if err := nImg.mw.SharpenImage(0, sig); err != nil {
-		return errors.Wrap(err, "cannot sharpen image")
+	switch {
+	case page == AllPages:
+		if err := img.mw.ReadImage(name); err != nil {
+			return errors.Wrapf(err, "cannot read image from %s", name)
+		}
+		// frames of animations may only cover the changed area, every operation needs full frames
+		if img.pages > 1 {
+			coalesced := img.mw.CoalesceImages()
+			img.mw.Destroy()
+			img.mw = coalesced
+		}
+	case animation && img.pages > 1:
+		// a single frame of an animation is only complete after composing it with its predecessors
+		all := imagick.NewMagickWand()
+		if err := all.ReadImage(fmt.Sprintf("%s[0-%d]", name, page)); err != nil {
+			all.Destroy()
+			return errors.Wrapf(err, "cannot read frame %d from %s", page, name)
+		}
+		coalesced := all.CoalesceImages()
+		all.Destroy()
+		coalesced.SetIteratorIndex(page)
+		img.mw.Destroy()
+		img.mw = coalesced.GetImage()
+		coalesced.Destroy()
+	default:
+		if err := img.mw.ReadImage(fmt.Sprintf("%s[%d]", name, page)); err != nil {
+			return errors.Wrapf(err, "cannot read page %d from %s", page, name)
+		}
 	}
 	return nil
 }
 
-func (ni *imagickImageHandler) Blur(img any, sigma string) error {
-	nImg, ok := img.(*imagickImage)
-	if !ok {
-		return errors.Errorf("cannot convert %T to *imagickImage", img)
+// readDocument renders every page of a ghostscript format in one pass and keeps page or every page for AllPages.
+// Pinging would run ghostscript over the whole document a second time.
+func (img *imagickImage) readDocument(name string, page int) error {
+	if err := img.mw.ReadImage(name); err != nil {
+		return errors.Wrapf(err, "cannot read image from %s", name)
 	}
-	sig, err := strconv.ParseFloat(sigma, 64)
-	if err != nil {
-		return errors.Wrapf(err, "invalid sigma '%s'", sigma)
+	img.pages = int(img.mw.GetNumberImages())
+	if page == AllPages {
+		return nil
 	}
-	if err := nImg.mw.BlurImage(0, sig); err != nil {
-		return errors.Wrap(err, "cannot sharpen image")
+	if page < 0 || page >= img.pages {
+		return errors.Wrapf(ErrPageNotFound, "page %d of %d", page, img.pages)
 	}
+	img.mw.SetIteratorIndex(page)
+	single := img.mw.GetImage()
+	img.mw.Destroy()
+	img.mw = single
 	return nil
 }
 
-var sizeRegexp = regexp.MustCompile(`(\d+)x(\d+)`)
+// librawQualities are the values of user_qual of libraw
+var librawQualities = map[Demosaic]int{
+	DemosaicLinear: 0,
+	DemosaicVNG:    1,
+	DemosaicPPG:    2,
+	DemosaicAHD:    3,
+	DemosaicDCB:    4,
+	DemosaicDHT:    11,
+}
 
-func (ni *imagickImageHandler) Resize(imgAny any, size string, resizeType ResizeType) error {
-	img, ok := imgAny.(*imagickImage)
+// librawColorSpaces are the values of output_color of libraw
+var librawColorSpaces = map[RawColorSpace]int{
+	RawColorSpaceRaw:      0,
+	RawColorSpaceSRGB:     1,
+	RawColorSpaceAdobe:    2,
+	RawColorSpaceWide:     3,
+	RawColorSpaceProPhoto: 4,
+	RawColorSpaceXYZ:      5,
+}
+
+func (ni *imagickImageHandler) DecodeRaw(in io.Reader, format string, whiteBalance WhiteBalance, demosaic Demosaic, colorSpace RawColorSpace) (Image, error) {
+	if !ni.libraw || !IsRawFormat(format) {
+		return nil, errors.Wrapf(ErrNotSupported, "camera raw format '%s'", format)
+	}
+	name, cleanup, err := spoolFile(in, ni.tempDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot spool image data")
+	}
+	defer cleanup()
+	res := &imagickImage{
+		mw:    imagick.NewMagickWand(),
+		pages: 1,
+	}
+	// all options of the dng coder are set, so the defaults of the installation do not matter
+	options := [][2]string{
+		{"dng:use-camera-wb", strconv.FormatBool(whiteBalance == WhiteBalanceCamera)},
+		{"dng:use-auto-wb", strconv.FormatBool(whiteBalance == WhiteBalanceAuto)},
+		{"dng:interpolation-quality", strconv.Itoa(librawQualities[demosaic])},
+		{"dng:output-color", strconv.Itoa(librawColorSpaces[colorSpace])},
+		{"dng:read-thumbnail", "false"},
+	}
+	for _, option := range options {
+		if err := res.mw.SetOption(option[0], option[1]); err != nil {
+			res.mw.Destroy()
+			return nil, errors.Wrapf(err, "cannot set option %s=%s", option[0], option[1])
+		}
+	}
+	// the explicit coder keeps imagemagick from guessing the format by its content
+	if err := res.mw.ReadImage(fmt.Sprintf("%s:%s", strings.ToUpper(format), name)); err != nil {
+		res.mw.Destroy()
+		return nil, errors.Wrapf(err, "cannot develop %s image from %s", format, name)
+	}
+	if err := res.mw.SetImageDepth(16); err != nil {
+		res.mw.Destroy()
+		return nil, errors.Wrap(err, "cannot set depth 16")
+	}
+	ni.logger.Debug().Msgf("developed %s: %dx%d", format, res.mw.GetImageWidth(), res.mw.GetImageHeight())
+	return res, nil
+}
+
+func (ni *imagickImageHandler) Sharpen(img Image, sigma string) error {
+	nImg, err := toImagickImage(img)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	return nImg.eachFrame(func() error {
+		if err := nImg.mw.SharpenImage(0, sig); err != nil {
+			return errors.Wrap(err, "cannot sharpen image")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) Blur(img Image, sigma string) error {
+	nImg, err := toImagickImage(img)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	return nImg.eachFrame(func() error {
+		if err := nImg.mw.BlurImage(0, sig); err != nil {
+			return errors.Wrap(err, "cannot blur image")
+		}
+		return nil
+	})
+}
+
+var imagickFilters = map[Filter]imagick.FilterType{
+	FilterLanczos:  imagick.FILTER_LANCZOS,
+	FilterMitchell: imagick.FILTER_MITCHELL,
+	FilterCatrom:   imagick.FILTER_CATROM,
+	FilterBox:      imagick.FILTER_BOX,
+	FilterNearest:  imagick.FILTER_POINT,
+	FilterTriangle: imagick.FILTER_TRIANGLE,
+}
+
+func (ni *imagickImageHandler) Resize(imgAny Image, size string, resizeType ResizeType, anchor CropAnchor, background color.NRGBA, upscale bool, filter Filter) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
+	}
+	scaled, box, err := resizeGeometry(int(img.mw.GetImageWidth()), int(img.mw.GetImageHeight()), size, resizeType, upscale)
+	if err != nil {
+		return err
+	}
+	if resizeType == ResizeTypeSmartCrop {
+		sample, err := img.sample()
+		if err != nil {
+			return err
+		}
+		anchor = smartCropAnchor(sample, box.Width, box.Height)
+		resizeType = ResizeTypeCrop
+	}
+	var pw *imagick.PixelWand
+	if resizeType == ResizeTypePad {
+		pw = imagick.NewPixelWand()
+		defer pw.Destroy()
+		bgColor := fmt.Sprintf("rgba(%d,%d,%d,%.4f)", background.R, background.G, background.B, float64(background.A)/255)
+		if !pw.SetColor(bgColor) {
+			return errors.Errorf("cannot set background color %s", bgColor)
+		}
+	}
+	return img.eachFrame(func() error {
+		if err := img.mw.ResizeImage(uint(scaled.Width), uint(scaled.Height), imagickFilters[filter]); err != nil {
+			return errors.Wrapf(err, "cannot resize image to %dx%d", scaled.Width, scaled.Height)
+		}
+		if resizeType == ResizeTypePad {
+			if err := img.mw.SetImageBackgroundColor(pw); err != nil {
+				return errors.Wrapf(err, "cannot set background color %s", pw.GetColorAsString())
+			}
+			// the background of the extent is only transparent with an alpha channel
+			if background.A < 0xff && !img.mw.GetImageAlphaChannel() {
+				if err := img.mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+					return errors.Wrap(err, "cannot add alpha channel")
+				}
+			}
+			x, y := anchor.Position(box.Width, box.Height, scaled.Width, scaled.Height)
+			if err := img.mw.ExtentImage(uint(box.Width), uint(box.Height), -x, -y); err != nil {
+				return errors.Wrapf(err, "cannot pad image to %dx%d", box.Width, box.Height)
+			}
+			if err := img.mw.ResetImagePage(""); err != nil {
+				return errors.Wrap(err, "cannot reset image page")
+			}
+		}
+		if resizeType == ResizeTypeCrop {
+			x, y := anchor.Position(scaled.Width, scaled.Height, box.Width, box.Height)
+			if err := img.mw.CropImage(uint(box.Width), uint(box.Height), x, y); err != nil {
+				return errors.Wrapf(err, "cannot crop image to %dx%d", box.Width, box.Height)
+			}
+			if err := img.mw.ResetImagePage(""); err != nil {
+				return errors.Wrap(err, "cannot reset image page")
+			}
+		}
+		return nil
+	})
+}
+
+// sample returns a copy of the (first frame of the) image scaled to at most smartCropSampleSize pixels
+func (img *imagickImage) sample() (image.Image, error) {
+	mw := img.mw.GetImage()
+	defer mw.Destroy()
+	cols, rows := mw.GetImageWidth(), mw.GetImageHeight()
+	scale := math.Min(1, float64(smartCropSampleSize)/float64(max(cols, rows)))
+	cols, rows = max(1, uint(float64(cols)*scale)), max(1, uint(float64(rows)*scale))
+	if err := mw.ThumbnailImage(cols, rows); err != nil {
+		return nil, errors.Wrapf(err, "cannot scale sample to %dx%d", cols, rows)
+	}
+	pixels, err := mw.ExportImagePixels(0, 0, cols, rows, "RGBA", imagick.PIXEL_CHAR)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot export sample pixels")
+	}
+	data, ok := pixels.([]byte)
 	if !ok {
-		return errors.Errorf("cannot convert %T to image.Image", imgAny)
+		return nil, errors.Errorf("cannot convert %T to []byte", pixels)
+	}
+	return &image.NRGBA{Pix: data, Stride: int(cols) * 4, Rect: image.Rect(0, 0, int(cols), int(rows))}, nil
+}
+
+func (ni *imagickImageHandler) Crop(imgAny Image, x, y, width, height int) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := checkCrop(img, x, y, width, height); err != nil {
+		return err
 	}
-	cols, rows, err := img.mw.GetSize()
+	return img.eachFrame(func() error {
+		if err := img.mw.CropImage(uint(width), uint(height), x, y); err != nil {
+			return errors.Wrapf(err, "cannot crop image to %dx%d+%d+%d", width, height, x, y)
+		}
+		if err := img.mw.ResetImagePage(""); err != nil {
+			return errors.Wrap(err, "cannot reset image page")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) Rotate(imgAny Image, degrees float64, background color.NRGBA) error {
+	img, err := toImagickImage(imgAny)
 	if err != nil {
-		return errors.Wrap(err, "cannot get image size")
+		return err
 	}
-	if cols == 0 || rows == 0 {
-		return errors.New("image size is 0")
+	degrees = normalizeDegrees(degrees)
+	if degrees == 0 {
+		return nil
 	}
-	sizeParts := sizeRegexp.FindStringSubmatch(size)
-	if len(sizeParts) != 3 {
-		return errors.Errorf("invalid size format '%s'", size)
+	// imagemagick uses lossless integral rotation for multiples of 90 degrees
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	bgColor := fmt.Sprintf("rgba(%d,%d,%d,%.4f)", background.R, background.G, background.B, float64(background.A)/255)
+	if !pw.SetColor(bgColor) {
+		return errors.Errorf("cannot set background color %s", bgColor)
 	}
-	width, err := strconv.Atoi(sizeParts[1])
+	return img.eachFrame(func() error {
+		if err := img.mw.RotateImage(pw, degrees); err != nil {
+			return errors.Wrapf(err, "cannot rotate image by %v degrees", degrees)
+		}
+		if err := img.mw.ResetImagePage(""); err != nil {
+			return errors.Wrap(err, "cannot reset image page")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) Mirror(imgAny Image) error {
+	img, err := toImagickImage(imgAny)
 	if err != nil {
-		return errors.Wrapf(err, "invalid width '%s'", sizeParts[1])
+		return err
 	}
-	height, err := strconv.Atoi(sizeParts[2])
+	return img.eachFrame(func() error {
+		if err := img.mw.FlopImage(); err != nil {
+			return errors.Wrap(err, "cannot mirror image")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) Composite(imgAny, overlayAny Image, x, y int, opacity float64) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
+	}
+	overlay, err := toImagickImage(overlayAny)
 	if err != nil {
-		return errors.Wrapf(err, "invalid height '%s'", sizeParts[2])
-	}
-
-	if width == 0 && height == 0 {
-		return errors.New("both width and height are 0")
-	}
-	var newWidth, newHeight uint
-	switch resizeType {
-	case ResizeTypeAspect:
-		if width == 0 {
-			width = math.MaxInt
-		}
-		if height == 0 {
-			height = math.MaxInt
-		}
-		rectAspect := cols / rows
-		thumbAspect := uint(width) / uint(height)
-		newHeight = uint(height)
-		newWidth = uint(width)
-		if rectAspect > thumbAspect {
-			newHeight = rows * uint(width) / cols
-		} else {
-			newWidth = cols * uint(height) / rows
-		}
-	case ResizeTypeStretch:
-		if width == 0 || height == 0 {
-			return errors.New("both width and height must be set for stretch resize")
-		}
-		newWidth = uint(width)
-		newHeight = uint(height)
-	case ResizeTypeCrop:
-		if width == 0 || height == 0 {
-			return errors.New("both width and height must be set for crop resize")
-		}
-		rectAspect := cols / rows
-		thumbAspect := uint(width) / uint(height)
-		newHeight = uint(height)
-		newWidth = uint(width)
-		if rectAspect < thumbAspect {
-			newHeight = rows * uint(width) / cols
-		} else {
-			newWidth = cols * uint(height) / rows
+		return err
+	}
+	if err := checkOpacity(opacity); err != nil {
+		return err
+	}
+	if opacity < 1 {
+		if !overlay.mw.GetImageAlphaChannel() {
+			if err := overlay.mw.SetImageAlphaChannel(imagick.ALPHA_CHANNEL_SET); err != nil {
+				return errors.Wrap(err, "cannot add alpha channel to overlay")
+			}
 		}
-	default:
-		return errors.Errorf("unsupported resize type %d", resizeType)
+		// scale the alpha channel only
+		mask := overlay.mw.SetImageChannelMask(imagick.CHANNEL_ALPHA)
+		err := overlay.mw.EvaluateImage(imagick.EVAL_OP_MULTIPLY, opacity)
+		overlay.mw.SetImageChannelMask(mask)
+		if err != nil {
+			return errors.Wrapf(err, "cannot set overlay opacity to %v", opacity)
+		}
+	}
+	return img.eachFrame(func() error {
+		if err := img.mw.CompositeImage(overlay.mw, imagick.COMPOSITE_OP_OVER, true, x, y); err != nil {
+			return errors.Wrapf(err, "cannot composite overlay at %d,%d", x, y)
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) AutoOrient(imgAny Image) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
 	}
-	if err := img.mw.ResizeImage(newWidth, newHeight, imagick.FILTER_LANCZOS); err != nil {
-		return errors.Wrapf(err, "cannot resize image to %dx%d", newWidth, newHeight)
+	return img.eachFrame(func() error {
+		orientation := img.mw.GetImageOrientation()
+		if orientation == imagick.ORIENTATION_UNDEFINED || orientation == imagick.ORIENTATION_TOP_LEFT {
+			return nil
+		}
+		// AutoOrientImage sets the orientation to top-left afterwards
+		if err := img.mw.AutoOrientImage(); err != nil {
+			return errors.Wrapf(err, "cannot auto orient image with orientation %d", orientation)
+		}
+		if err := img.mw.ResetImagePage(""); err != nil {
+			return errors.Wrap(err, "cannot reset image page")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) TransformColorProfile(imgAny Image, target, fallback []byte) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
 	}
-	if resizeType == ResizeTypeCrop {
-		if err := img.mw.CropImage(uint(width), uint(height), int((newWidth-uint(width))/2), int((newHeight-uint(height))/2)); err != nil {
-			return errors.Wrapf(err, "cannot crop image to %dx%d", width, height)
+	return img.eachFrame(func() error {
+		// the first profile of an image is assigned, every further one converts the pixels
+		if len(img.mw.GetImageProfileBytes("icc")) == 0 {
+			if fallback != nil {
+				if err := img.mw.ProfileImage("icc", fallback); err != nil {
+					return errors.Wrap(err, "cannot assign fallback color profile")
+				}
+			} else if img.mw.GetImageColorspace() == imagick.COLORSPACE_CMYK {
+				if err := img.mw.TransformImageColorspace(imagick.COLORSPACE_SRGB); err != nil {
+					return errors.Wrap(err, "cannot convert cmyk image to srgb")
+				}
+			}
 		}
+		if err := img.mw.ProfileImage("icc", target); err != nil {
+			return errors.Wrap(err, "cannot convert to color profile")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) StripColorProfile(imgAny Image) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
 	}
-	return nil
+	return img.eachFrame(func() error {
+		img.mw.RemoveImageProfile("icc")
+		return nil
+	})
+}
+
+var imagickColorSpaces = map[ColorSpace]imagick.ColorspaceType{
+	ColorSpaceGray:    imagick.COLORSPACE_GRAY,
+	ColorSpaceBitonal: imagick.COLORSPACE_GRAY,
+	ColorSpaceCMYK:    imagick.COLORSPACE_CMYK,
+	ColorSpaceLab:     imagick.COLORSPACE_LAB,
+}
+
+func (ni *imagickImageHandler) ConvertColorSpace(imgAny Image, colorSpace ColorSpace, threshold float64, dither bool) error {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := checkThreshold(threshold); err != nil {
+		return err
+	}
+	// the gray50 pattern consists of black and white pixels only
+	var bitonal *imagick.MagickWand
+	if colorSpace == ColorSpaceBitonal && dither {
+		bitonal = imagick.NewMagickWand()
+		defer bitonal.Destroy()
+		if err := bitonal.ReadImage("pattern:gray50"); err != nil {
+			return errors.Wrap(err, "cannot create bitonal palette")
+		}
+	}
+	return img.eachFrame(func() error {
+		if err := img.mw.TransformImageColorspace(imagickColorSpaces[colorSpace]); err != nil {
+			return errors.Wrapf(err, "cannot convert to %s", colorSpace)
+		}
+		img.mw.RemoveImageProfile("icc")
+		if colorSpace != ColorSpaceBitonal {
+			return nil
+		}
+		if bitonal != nil {
+			if err := img.mw.RemapImage(bitonal, imagick.DITHER_METHOD_FLOYD_STEINBERG); err != nil {
+				return errors.Wrap(err, "cannot dither image")
+			}
+		} else if err := img.mw.ThresholdImage(threshold * float64(imagick.QUANTUM_RANGE)); err != nil {
+			return errors.Wrapf(err, "cannot threshold image at %v", threshold)
+		}
+		// bilevel images are written with 1 bit per pixel
+		if err := img.mw.SetImageType(imagick.IMAGE_TYPE_BILEVEL); err != nil {
+			return errors.Wrap(err, "cannot set bilevel type")
+		}
+		return nil
+	})
+}
+
+func (ni *imagickImageHandler) Metadata(imgAny Image) (*Metadata, error) {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return nil, err
+	}
+	iptc := img.mw.GetImageProfileBytes("iptc")
+	if len(iptc) == 0 {
+		iptc = img.mw.GetImageProfileBytes("8bim")
+	}
+	metadata := newMetadata(
+		img.mw.GetImageProfileBytes("exif"),
+		iptc,
+		img.mw.GetImageProfileBytes("xmp"),
+		img.mw.GetImageProfileBytes("icc"),
+	)
+	// tiff files carry the exif tags in the image file directory instead of an exif profile
+	if metadata.EXIF == nil {
+		for _, property := range img.mw.GetImageProperties("exif:*") {
+			if metadata.EXIF == nil {
+				metadata.EXIF = map[string]string{}
+			}
+			metadata.EXIF[strings.TrimPrefix(property, "exif:")] = img.mw.GetImageProperty(property)
+		}
+	}
+	return metadata, nil
+}
+
+// imagickDescriptiveProperties are written as tags by the tiff coder
+var imagickDescriptiveProperties = []string{"comment", "tiff:artist", "tiff:copyright", "tiff:document", "tiff:hostcomputer", "tiff:make", "tiff:model", "tiff:software", "tiff:timestamp"}
+
+// applyMetadataPolicy removes the descriptive profiles and properties of all frames unless policy is keep, the icc profile stays
+func (ni *imagickImageHandler) applyMetadataPolicy(img *imagickImage, policy MetadataPolicy) error {
+	if policy == MetadataKeep {
+		return nil
+	}
+	var r rights
+	if policy == MetadataRightsOnly {
+		metadata, err := ni.Metadata(img)
+		if err != nil {
+			return err
+		}
+		r = metadata.rights()
+	}
+	// every frame carries its own profiles and properties
+	return img.eachFrame(func() error {
+		for _, name := range img.mw.GetImageProfiles("*") {
+			if name == "icc" || name == "icm" {
+				continue
+			}
+			img.mw.RemoveImageProfile(name)
+		}
+		properties := append(img.mw.GetImageProperties("exif:*"), imagickDescriptiveProperties...)
+		for _, property := range properties {
+			if img.mw.GetImageProperty(property) == "" {
+				continue
+			}
+			if err := img.mw.DeleteImageProperty(property); err != nil {
+				return errors.Wrapf(err, "cannot delete property %s", property)
+			}
+		}
+		if exif := r.exif(); exif != nil {
+			if err := img.mw.SetImageProfile("exif", exif); err != nil {
+				return errors.Wrap(err, "cannot set exif profile")
+			}
+		}
+		if xmp := r.xmp(); xmp != nil {
+			if err := img.mw.SetImageProfile("xmp", xmp); err != nil {
+				return errors.Wrap(err, "cannot set xmp profile")
+			}
+		}
+		// the tiff coder writes artist and copyright from properties
+		if r.Creator != "" {
+			if err := img.mw.SetImageProperty("tiff:artist", r.Creator); err != nil {
+				return errors.Wrap(err, "cannot set artist")
+			}
+		}
+		if r.Copyright != "" {
+			if err := img.mw.SetImageProperty("tiff:copyright", r.Copyright); err != nil {
+				return errors.Wrap(err, "cannot set copyright")
+			}
+		}
+		return nil
+	})
 }
 
 var tileRegexp = regexp.MustCompile(`^(\d+)x(\d+)$`)
 
-func (ni *imagickImageHandler) Encode(imgAny any, writer io.Writer, format, compress string, quality int, tile string) (uint64, string, error) {
-	img, ok := imgAny.(*imagickImage)
-	if !ok {
-		return 0, "", errors.Errorf("cannot convert %T to image.Image", imgAny)
+func (ni *imagickImageHandler) Encode(imgAny Image, writer io.Writer, format, compress string, quality int, depth Depth, tile string, metadata MetadataPolicy) (uint64, string, error) {
+	img, err := toImagickImage(imgAny)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := ni.applyMetadataPolicy(img, metadata); err != nil {
+		return 0, "", err
+	}
+	if err := checkDepth(format, depth); err != nil {
+		return 0, "", err
+	}
+	if err := img.setDepth(depth); err != nil {
+		return 0, "", err
 	}
 	var mimetype string
 
+	// imagemagick would keep the compression of the master, tiffs are uncompressed by default
+	switch strings.ToLower(format) {
+	case "tif", "tiff", "ptif":
+		if compress == "" {
+			compress = "no"
+		}
+	}
 	if compress != "" {
 		compression, ok := compresionNames[compress]
 		if !ok {
 			return 0, "", errors.Errorf("unsupported compression '%s'", compress)
 		}
 		if err := img.mw.SetCompression(compression); err != nil {
-			return 0, "", errors.Wrapf(err, "cannot set compression to %s", compression)
+			return 0, "", errors.Wrapf(err, "cannot set compression to %s", compress)
 		}
 	}
 	if quality >= 0 && quality <= 100 {
@@ -203,6 +733,7 @@ func (ni *imagickImageHandler) Encode(imgAny any, writer io.Writer, format, comp
 			return 0, "", errors.Wrap(err, "cannot set compression quality to 85")
 		}
 	}
+	var magickFormat string
 	switch strings.ToLower(format) {
 	case "jp2":
 		mimetype = "image/jp2"
@@ -221,14 +752,10 @@ func (ni *imagickImageHandler) Encode(imgAny any, writer io.Writer, format, comp
 				return 0, "", errors.Wrap(err, "cannot set tile option")
 			}
 		}
-		if err := img.mw.SetFormat(strings.ToUpper(format)); err != nil {
-			return 0, "", errors.Wrapf(err, "cannot set format to %s", format)
-		}
+		magickFormat = "JP2"
 	case "ptif":
 		mimetype = "image/tiff"
-		if err := img.mw.SetFormat(strings.ToUpper("ptif")); err != nil {
-			return 0, "", errors.Wrapf(err, "cannot set format to %s", format)
-		}
+		magickFormat = "PTIF"
 		if tile != "" {
 			if err := img.mw.SetOption("tiff:tile-geometry", tile); err != nil {
 				return 0, "", errors.Wrapf(err, "cannot set tile geometry '%s'", tile)
@@ -236,41 +763,78 @@ func (ni *imagickImageHandler) Encode(imgAny any, writer io.Writer, format, comp
 		}
 	default:
 		mimetype = fmt.Sprintf("image/%s", format)
-		if err := img.mw.SetFormat(strings.ToUpper(format)); err != nil {
-			return 0, "", errors.Wrapf(err, "cannot set format to %s", format)
-		}
+		magickFormat = strings.ToUpper(format)
 	}
-	data, err := img.mw.GetImageBlob()
+	if err := img.mw.SetFormat(magickFormat); err != nil {
+		return 0, "", errors.Wrapf(err, "cannot set format to %s", format)
+	}
+	// write to a temporary file first, the explicit format prefix overrides any extension
+	fp, err := os.CreateTemp(ni.tempDir, "mediaserverimage-*")
 	if err != nil {
-		return 0, "", errors.Wrap(err, "cannot get image data")
+		return 0, "", errors.Wrapf(err, "cannot create temporary file in '%s'", ni.tempDir)
 	}
-	size, err := io.Copy(writer, strings.NewReader(string(data)))
+	defer func() {
+		_ = fp.Close()
+		_ = os.Remove(fp.Name())
+	}()
+	if img.mw.GetNumberImages() > 1 && (magickFormat == "GIF" || magickFormat == "WEBP") {
+		// animations keep all frames with their delays, gif frames are reduced to the changed area
+		mw := img.mw
+		if magickFormat == "GIF" {
+			mw = img.mw.OptimizeImageLayers()
+			defer mw.Destroy()
+		}
+		if err := mw.WriteImages(fmt.Sprintf("%s:%s", magickFormat, fp.Name()), true); err != nil {
+			return 0, "", errors.Wrapf(err, "cannot write animation to %s", fp.Name())
+		}
+	} else if err := img.mw.WriteImage(fmt.Sprintf("%s:%s", magickFormat, fp.Name())); err != nil {
+		return 0, "", errors.Wrapf(err, "cannot write image to %s", fp.Name())
+	}
+	size, err := io.Copy(writer, fp)
 	if err != nil {
 		return 0, "", errors.Wrap(err, "cannot write image data")
 	}
-	data = nil
 	return uint64(size), mimetype, nil
 }
 
-func (ni *imagickImageHandler) GetDimension(imgAny any) (int, int) {
-	img, ok := imgAny.(*imagickImage)
-	if !ok {
-		return 0, 0
+// imagickDepths are the sample depths written for depth
+var imagickDepths = map[Depth]uint{
+	Depth8:   8,
+	Depth16:  16,
+	Depth32F: 32,
+}
+
+// setDepth sets the depth of all frames, the pixel cache keeps the quantum depth of the build
+func (img *imagickImage) setDepth(depth Depth) error {
+	if depth == DepthSource {
+		return nil
 	}
-	cols, rows, err := img.mw.GetSize()
-	if err != nil {
-		return 0, 0
+	quantumFormat := "integer"
+	if depth == Depth32F {
+		quantumFormat = "floating-point"
+	}
+	if err := img.mw.SetOption("quantum:format", quantumFormat); err != nil {
+		return errors.Wrapf(err, "cannot set quantum format %s", quantumFormat)
 	}
-	return int(cols), int(rows)
+	return img.eachFrame(func() error {
+		if err := img.mw.SetImageDepth(imagickDepths[depth]); err != nil {
+			return errors.Wrapf(err, "cannot set depth %s", depth)
+		}
+		return nil
+	})
 }
 
-func (ni *imagickImageHandler) Release(imgAny any) error {
+// toImagickImage returns the imagickImage behind imgAny or an error if it has already been closed
+func toImagickImage(imgAny Image) (*imagickImage, error) {
 	img, ok := imgAny.(*imagickImage)
 	if !ok {
-		return errors.Errorf("cannot convert %T to image.Image", imgAny)
+		return nil, errors.Errorf("cannot convert %T to *imagickImage", imgAny)
 	}
-	img.mw.Destroy()
-	return nil
+	if img.mw == nil {
+		return nil, errors.New("image has already been closed")
+	}
+	return img, nil
 }
 
 var _ ImageHandler = &imagickImageHandler{}
+var _ Image = &imagickImage{}
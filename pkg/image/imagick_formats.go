@@ -22,6 +22,7 @@ var compresionNames = map[string]imagick.CompressionType{
 	"lzw":           imagick.COMPRESSION_LZW,
 	"rle":           imagick.COMPRESSION_RLE,
 	"zip":           imagick.COMPRESSION_ZIP,
+	"deflate":       imagick.COMPRESSION_ZIP,
 	"zips":          imagick.COMPRESSION_ZIPS,
 	"piz":           imagick.COMPRESSION_PIZ,
 	"pxr24":         imagick.COMPRESSION_PXR24,
@@ -32,6 +33,19 @@ var compresionNames = map[string]imagick.CompressionType{
 	"jbig2":         imagick.COMPRESSION_JBIG2,
 }
 
+var colorspaceNames = map[imagick.ColorspaceType]string{
+	imagick.COLORSPACE_SRGB:  "srgb",
+	imagick.COLORSPACE_RGB:   "rgb",
+	imagick.COLORSPACE_SCRGB: "scrgb",
+	imagick.COLORSPACE_GRAY:  "gray",
+	imagick.COLORSPACE_CMYK:  "cmyk",
+	imagick.COLORSPACE_CMY:   "cmy",
+	imagick.COLORSPACE_LAB:   "lab",
+	imagick.COLORSPACE_XYZ:   "xyz",
+	imagick.COLORSPACE_YCBCR: "ycbcr",
+	imagick.COLORSPACE_HSV:   "hsv",
+}
+
 var imageFormatDescription = map[string]string{
 	"3FR":    "Hasselblad CFV/H3D39II Raw Format",
 	"3G2":    "Media Container",
@@ -324,3 +338,6 @@ var imageFormatDescription = map[string]string{
 }
 
 var imageFormats = maps.Keys(imageFormatDescription)
+
+// ghostscriptFormats are rendered by ghostscript, which processes the whole document even when pinged
+var ghostscriptFormats = []string{"AI", "EPDF", "PDF", "PDFA"}
@@ -0,0 +1,48 @@
+//go:build imagick && !vips && cgo
+
+package image
+
+import (
+	"emperror.dev/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imagickPolicy disables the coders which hand postscript to ghostscript, pdf stays readable.
+// Further restrictions of the system policy.xml still apply.
+const imagickPolicy = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE policymap [
+  <!ELEMENT policymap (policy)*>
+  <!ATTLIST policymap xmlns CDATA #FIXED "">
+  <!ELEMENT policy EMPTY>
+  <!ATTLIST policy xmlns CDATA #FIXED "" domain NMTOKEN #REQUIRED
+    name NMTOKEN #IMPLIED pattern CDATA #IMPLIED rights NMTOKEN #IMPLIED
+    stealth NMTOKEN #IMPLIED value CDATA #IMPLIED>
+]>
+<policymap>
+  <policy domain="coder" rights="none" pattern="{PS,PS2,PS3,EPS,EPI,EPSF,EPSI,EPT,XPS,PCL}" />
+</policymap>
+`
+
+// installPolicy writes imagickPolicy to a new directory in tempDir and prepends it to MAGICK_CONFIGURE_PATH.
+// It has to run before imagick.Initialize, the returned directory is removed on Close.
+func installPolicy(tempDir string) (string, error) {
+	dir, err := os.MkdirTemp(tempDir, "mediaserverimage-policy-*")
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create policy directory in '%s'", tempDir)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "policy.xml"), []byte(imagickPolicy), 0o644); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", errors.Wrapf(err, "cannot write policy to %s", dir)
+	}
+	paths := []string{dir}
+	if current := os.Getenv("MAGICK_CONFIGURE_PATH"); current != "" {
+		paths = append(paths, current)
+	}
+	if err := os.Setenv("MAGICK_CONFIGURE_PATH", strings.Join(paths, string(os.PathListSeparator))); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", errors.Wrap(err, "cannot set MAGICK_CONFIGURE_PATH")
+	}
+	return dir, nil
+}
@@ -0,0 +1,169 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Metadata holds the descriptive metadata embedded in an image
+type Metadata struct {
+	EXIF map[string]string   `json:"exif,omitempty"`
+	IPTC map[string][]string `json:"iptc,omitempty"`
+	XMP  string              `json:"xmp,omitempty"`
+	ICC  *ICCInfo            `json:"icc,omitempty"`
+}
+
+// ICCInfo describes an embedded icc profile
+type ICCInfo struct {
+	Description string `json:"description,omitempty"`
+	Copyright   string `json:"copyright,omitempty"`
+	Class       string `json:"class"`
+	ColorSpace  string `json:"colorspace"`
+	Version     string `json:"version"`
+	Size        int    `json:"size"`
+}
+
+// newMetadata parses raw exif (tiff structure), iptc (iim or photoshop resources), xmp and icc data
+func newMetadata(exif, iptc, xmp, icc []byte) *Metadata {
+	return &Metadata{
+		EXIF: parseExif(exif),
+		IPTC: parseIPTC(iptc),
+		XMP:  strings.TrimSpace(strings.TrimRight(string(xmp), "\x00")),
+		ICC:  parseICC(icc),
+	}
+}
+
+// iptcNames names the datasets of the iptc application record (2)
+var iptcNames = map[byte]string{
+	5:   "ObjectName",
+	15:  "Category",
+	20:  "SupplementalCategories",
+	25:  "Keywords",
+	40:  "SpecialInstructions",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	95:  "Province-State",
+	101: "Country-PrimaryLocationName",
+	103: "OriginalTransmissionReference",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	118: "Contact",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+// photoshopIPTC returns the iptc resource (0x0404) of photoshop image resources
+func photoshopIPTC(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("Photoshop 3.0\x00"))
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:])
+		// pascal string, padded to an even length including the length byte
+		nameLen := int(data[6]) + 1
+		nameLen += nameLen % 2
+		pos := 6 + nameLen
+		if pos+4 > len(data) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		pos += 4
+		if pos+size > len(data) {
+			return nil
+		}
+		if id == 0x0404 {
+			return data[pos : pos+size]
+		}
+		// the pad byte after an odd size may be missing in the last resource
+		data = data[min(pos+size+size%2, len(data)):]
+	}
+	return nil
+}
+
+// parseIPTC returns the named datasets of the iptc application record
+func parseIPTC(data []byte) map[string][]string {
+	if bytes.HasPrefix(data, []byte("Photoshop 3.0\x00")) || bytes.HasPrefix(data, []byte("8BIM")) {
+		data = photoshopIPTC(data)
+	}
+	result := map[string][]string{}
+	for len(data) >= 5 && data[0] == 0x1c {
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		if size&0x8000 != 0 || 5+size > len(data) {
+			// extended datasets are not used for text
+			break
+		}
+		if name, ok := iptcNames[dataset]; ok && record == 2 {
+			result[name] = append(result[name], strings.TrimSpace(string(data[5:5+size])))
+		}
+		data = data[5+size:]
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// parseICC returns the header information and the description of an icc profile
+func parseICC(data []byte) *ICCInfo {
+	if checkColorProfile(data) != nil {
+		return nil
+	}
+	info := &ICCInfo{
+		Class:      strings.TrimSpace(string(data[12:16])),
+		ColorSpace: strings.TrimSpace(string(data[16:20])),
+		Version:    fmt.Sprintf("%d.%d", data[8], data[9]>>4),
+		Size:       len(data),
+	}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+i*12+12 <= len(data); i++ {
+		entry := data[132+i*12:]
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+		if offset+size > len(data) || size < 12 {
+			continue
+		}
+		switch string(entry[:4]) {
+		case "desc":
+			info.Description = iccText(data[offset : offset+size])
+		case "cprt":
+			info.Copyright = iccText(data[offset : offset+size])
+		}
+	}
+	return info
+}
+
+// iccText decodes the text of a desc, text or mluc tag, for mluc the first record is used
+func iccText(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		length := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+length > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+length]), "\x00")
+	case "text":
+		return strings.TrimRight(string(tag[8:]), "\x00")
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
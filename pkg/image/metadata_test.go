@@ -0,0 +1,57 @@
+package image
+
+import (
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/configs"
+	"io/fs"
+	"testing"
+)
+
+func TestParseIPTC(t *testing.T) {
+	iim := []byte{0x1c, 2, 25, 0, 3, 'o', 'n', 'e', 0x1c, 2, 25, 0, 3, 't', 'w', 'o', 0x1c, 2, 116, 0, 2, '(', 'c'}
+	// photoshop resource 0x0404 with an empty name
+	resource := append([]byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00"), 0, 0, 0, byte(len(iim)))
+	resource = append(resource, iim...)
+	for name, data := range map[string][]byte{"iim": iim, "photoshop": resource} {
+		iptc := parseIPTC(data)
+		if keywords := iptc["Keywords"]; len(keywords) != 2 || keywords[0] != "one" || keywords[1] != "two" {
+			t.Errorf("%s: got keywords %v, want [one two]", name, keywords)
+		}
+		if copyright := iptc["CopyrightNotice"]; len(copyright) != 1 || copyright[0] != "(c" {
+			t.Errorf("%s: got copyright %v, want [(c]", name, copyright)
+		}
+	}
+	// a last resource of odd size without pad byte and truncated resources
+	for _, data := range []string{"8BIM\x04\x05\x00\x00\x00\x00\x00\x01X", "8BIM\x04\x05\x00\x00\x00\x00\x00\x09X", "8BIM\x04\x05\xff"} {
+		if iptc := parseIPTC([]byte(data)); len(iptc) != 0 {
+			t.Errorf("%q: got %v, want nothing", data, iptc)
+		}
+	}
+}
+
+func TestParseICC(t *testing.T) {
+	srgb, err := fs.ReadFile(configs.ICCFS, "icc/srgb.icc")
+	if err != nil {
+		t.Fatalf("cannot read srgb profile: %v", err)
+	}
+	info := parseICC(srgb)
+	if info == nil {
+		t.Fatal("cannot parse srgb profile")
+	}
+	if info.ColorSpace != "RGB" || info.Class != "mntr" || info.Size != len(srgb) {
+		t.Errorf("got %+v", info)
+	}
+	if info.Description == "" {
+		t.Error("no description")
+	}
+	// a header without tag count must not be read beyond its end
+	for size := 128; size < 132; size++ {
+		header := make([]byte, size)
+		copy(header[36:], "acsp")
+		if info := parseICC(header); info != nil {
+			t.Errorf("%d byte profile parsed: %+v", size, info)
+		}
+		if err := checkColorProfile(header); err == nil {
+			t.Errorf("%d byte profile accepted", size)
+		}
+	}
+}
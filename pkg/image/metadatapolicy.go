@@ -0,0 +1,178 @@
+package image
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"encoding/binary"
+	"encoding/xml"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// MetadataPolicy decides which descriptive metadata is written on encode.
+// The icc profile is not affected, see StripColorProfile.
+type MetadataPolicy int
+
+const (
+	// MetadataKeep writes the metadata of the source image
+	MetadataKeep MetadataPolicy = iota
+	// MetadataStrip removes exif, iptc, xmp and comments
+	MetadataStrip
+	// MetadataRightsOnly removes everything but the creator and the rights statement
+	MetadataRightsOnly
+)
+
+var metadataPolicyNames = map[string]MetadataPolicy{
+	"keep":        MetadataKeep,
+	"strip":       MetadataStrip,
+	"rights-only": MetadataRightsOnly,
+}
+
+// ParseMetadataPolicy parses "keep", "strip" or "rights-only"
+func ParseMetadataPolicy(name string) (MetadataPolicy, error) {
+	policy, ok := metadataPolicyNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, errors.Errorf("invalid metadata policy '%s'", name)
+	}
+	return policy, nil
+}
+
+func (p MetadataPolicy) String() string {
+	for name, policy := range metadataPolicyNames {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// rights holds the metadata which survives the rights-only policy
+type rights struct {
+	Creator      string
+	Copyright    string
+	WebStatement string
+	UsageTerms   string
+}
+
+func (r rights) empty() bool {
+	return r == rights{}
+}
+
+var (
+	xmpCreatorRegexp      = regexp.MustCompile(`(?s)<dc:creator>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+	xmpRightsRegexp       = regexp.MustCompile(`(?s)<dc:rights>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+	xmpUsageTermsRegexp   = regexp.MustCompile(`(?s)<xmpRights:UsageTerms>.*?<rdf:li[^>]*>(.*?)</rdf:li>`)
+	xmpWebStatementRegexp = regexp.MustCompile(`xmpRights:WebStatement(?:="([^"]*)"|>([^<]*)<)`)
+)
+
+// xmpValue returns the first non-empty group of re in xmp
+func xmpValue(xmp string, re *regexp.Regexp) string {
+	match := re.FindStringSubmatch(xmp)
+	for i := 1; i < len(match); i++ {
+		if group := match[i]; group != "" {
+			return strings.TrimSpace(html.UnescapeString(group))
+		}
+	}
+	return ""
+}
+
+// rights collects creator and rights statement, exif takes precedence over iptc and xmp
+func (m *Metadata) rights() rights {
+	var r rights
+	if m == nil {
+		return r
+	}
+	first := func(values ...string) string {
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	iptc := func(name string) string {
+		if values := m.IPTC[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	r.Creator = first(m.EXIF["Artist"], iptc("By-line"), xmpValue(m.XMP, xmpCreatorRegexp))
+	r.Copyright = first(m.EXIF["Copyright"], iptc("CopyrightNotice"), xmpValue(m.XMP, xmpRightsRegexp))
+	r.WebStatement = xmpValue(m.XMP, xmpWebStatementRegexp)
+	r.UsageTerms = xmpValue(m.XMP, xmpUsageTermsRegexp)
+	return r
+}
+
+// exif returns a raw exif blob ("Exif\0\0" and a big endian tiff structure) with artist and copyright
+func (r rights) exif() []byte {
+	type field struct {
+		tag   uint16
+		value string
+	}
+	var fields []field
+	if r.Creator != "" {
+		fields = append(fields, field{tag: 0x013b, value: r.Creator})
+	}
+	if r.Copyright != "" {
+		fields = append(fields, field{tag: 0x8298, value: r.Copyright})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	// offsets are relative to the tiff header, values follow the directory
+	ifd := binary.BigEndian.AppendUint16(nil, uint16(len(fields)))
+	var values []byte
+	valueOffset := 8 + 2 + len(fields)*12 + 4
+	for _, f := range fields {
+		value := append([]byte(f.value), 0)
+		ifd = binary.BigEndian.AppendUint16(ifd, f.tag)
+		ifd = binary.BigEndian.AppendUint16(ifd, 2)
+		ifd = binary.BigEndian.AppendUint32(ifd, uint32(len(value)))
+		if len(value) <= 4 {
+			ifd = append(ifd, append(value, make([]byte, 4-len(value))...)...)
+			continue
+		}
+		ifd = binary.BigEndian.AppendUint32(ifd, uint32(valueOffset+len(values)))
+		values = append(values, value...)
+		if len(values)%2 != 0 {
+			values = append(values, 0)
+		}
+	}
+	// no next directory
+	ifd = binary.BigEndian.AppendUint32(ifd, 0)
+	data := []byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08")
+	data = append(data, ifd...)
+	return append(data, values...)
+}
+
+// xmp returns an xmp packet with dc:creator, dc:rights and the xmpRights properties
+func (r rights) xmp() []byte {
+	if r.empty() {
+		return nil
+	}
+	escape := func(s string) string {
+		buf := &bytes.Buffer{}
+		_ = xml.EscapeText(buf, []byte(s))
+		return buf.String()
+	}
+	sb := &strings.Builder{}
+	sb.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	sb.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	sb.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	sb.WriteString("  <rdf:Description rdf:about=\"\" xmlns:dc=\"http://purl.org/dc/elements/1.1/\" xmlns:xmpRights=\"http://ns.adobe.com/xap/1.0/rights/\">\n")
+	if r.Creator != "" {
+		sb.WriteString("   <dc:creator><rdf:Seq><rdf:li>" + escape(r.Creator) + "</rdf:li></rdf:Seq></dc:creator>\n")
+	}
+	if r.Copyright != "" {
+		sb.WriteString("   <dc:rights><rdf:Alt><rdf:li xml:lang=\"x-default\">" + escape(r.Copyright) + "</rdf:li></rdf:Alt></dc:rights>\n")
+	}
+	if r.UsageTerms != "" {
+		sb.WriteString("   <xmpRights:UsageTerms><rdf:Alt><rdf:li xml:lang=\"x-default\">" + escape(r.UsageTerms) + "</rdf:li></rdf:Alt></xmpRights:UsageTerms>\n")
+	}
+	if r.WebStatement != "" {
+		sb.WriteString("   <xmpRights:WebStatement>" + escape(r.WebStatement) + "</xmpRights:WebStatement>\n")
+	}
+	sb.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return []byte(sb.String())
+}
@@ -3,131 +3,498 @@
 package image
 
 import (
+	"bufio"
+	"bytes"
 	"emperror.dev/errors"
+	"encoding/binary"
 	"github.com/je4/utils/v2/pkg/zLogger"
 	"github.com/nfnt/resize"
 	"github.com/oliamb/cutter"
 	"golang.org/x/image/bmp"
+	xdraw "golang.org/x/image/draw"
 	"golang.org/x/image/tiff"
 	_ "golang.org/x/image/vp8"
 	_ "golang.org/x/image/vp8l"
 	_ "golang.org/x/image/webp"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
-	"regexp"
-	"strconv"
+	"math"
+	"slices"
 	"strings"
 )
 
 type nativeImage struct {
-	img image.Image
+	img         image.Image
+	format      string
+	orientation int
+	metadata    *Metadata
+	// segments holds the metadata segments of jpeg sources, which the go decoders drop
+	segments []jpegAPP
+	// pages is the number of frames of gif sources, 1 otherwise
+	pages int
+	// animation holds the further frames if all frames of an animation are decoded, img is the first one
+	animation *nativeAnimation
 }
 
-func NewImageHandler(logger zLogger.ZLogger) ImageHandler {
+// jpegAPP is an APPn segment of a jpeg file
+type jpegAPP struct {
+	marker byte
+	data   []byte
+}
+
+func (nImg *nativeImage) Dimensions() (int, int) {
+	if nImg.img == nil {
+		return 0, 0
+	}
+	return nImg.img.Bounds().Dx(), nImg.img.Bounds().Dy()
+}
+
+func (nImg *nativeImage) Format() string {
+	return nImg.format
+}
+
+func (nImg *nativeImage) ColorSpace() string {
+	if nImg.img == nil {
+		return ""
+	}
+	switch nImg.img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return "gray"
+	case color.CMYKModel:
+		return "cmyk"
+	default:
+		return "srgb"
+	}
+}
+
+func (nImg *nativeImage) Pages() int {
+	return nImg.pages
+}
+
+func (nImg *nativeImage) Close() error {
+	nImg.img = nil
+	nImg.animation = nil
+	return nil
+}
+
+// each replaces the image and every further frame of an animation by the result of f
+func (nImg *nativeImage) each(f func(img image.Image) (image.Image, error)) error {
+	img, err := f(nImg.img)
+	if err != nil {
+		return err
+	}
+	nImg.img = img
+	if nImg.animation == nil {
+		return nil
+	}
+	for i, frame := range nImg.animation.frames {
+		if nImg.animation.frames[i], err = f(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewImageHandler creates a pure go handler.
+// Decoding and encoding stream directly, tempDir is not used.
+func NewImageHandler(tempDir string, logger zLogger.ZLogger) (ImageHandler, error) {
 	return &nativeImageHandler{
 		logger: logger,
-	}
+	}, nil
 }
 
 type nativeImageHandler struct {
 	logger zLogger.ZLogger
 }
 
-func (ni *nativeImageHandler) Decode(in io.Reader, _, _ int64, _ string) (any, error) {
-	img, format, err := image.Decode(in)
-	ni.logger.Debug().Msgf("format: %s", format)
+func (ni *nativeImageHandler) DecodeRaw(_ io.Reader, format string, _ WhiteBalance, _ Demosaic, _ RawColorSpace) (Image, error) {
+	return nil, errors.Wrapf(ErrNotSupported, "camera raw format '%s', use the imagick build", format)
+}
+
+func (ni *nativeImageHandler) Decode(in io.Reader, _, _ int64, format string, page, _ int) (Image, error) {
+	// vector formats need a rasteriser
+	if strings.EqualFold(format, "svg") || strings.EqualFold(format, "pdf") {
+		return nil, errors.Wrap(ErrNotSupported, strings.ToLower(format))
+	}
+	// the go decoders drop the exif data, so look at the header first
+	br := bufio.NewReaderSize(in, exifPeekSize)
+	head, _ := br.Peek(exifPeekSize)
+	orientation := exifOrientation(head)
+	metadata := headMetadata(head)
+	segments := headSegments(head)
+	var img image.Image
+	var animation *nativeAnimation
+	pages := 1
+	var err error
+	// the go decoders read only the first image, except for gif
+	if bytes.HasPrefix(head, []byte("GIF8")) {
+		var g *gif.GIF
+		if g, err = gif.DecodeAll(br); err != nil {
+			return nil, errors.Wrap(err, "cannot decode image")
+		}
+		format, pages = "gif", len(g.Image)
+		switch {
+		case page == AllPages:
+			frames := gifFrames(g, pages-1)
+			img = frames[0]
+			if pages > 1 {
+				animation = &nativeAnimation{frames: frames[1:], delays: g.Delay, loopCount: g.LoopCount}
+			}
+		case page >= 0 && page < pages:
+			img = gifFrames(g, page)[page]
+		}
+	} else if img, format, err = image.Decode(br); err != nil {
+		return nil, errors.Wrap(err, "cannot decode image")
+	}
+	if page != AllPages && (page < 0 || page >= pages) {
+		return nil, errors.Wrapf(ErrPageNotFound, "page %d of %d", page, pages)
+	}
+	ni.logger.Debug().Msgf("format: %s, orientation: %d, page %d of %d", format, orientation, page, pages)
 	res := &nativeImage{
-		img: img,
+		img:         img,
+		format:      format,
+		orientation: orientation,
+		metadata:    metadata,
+		segments:    segments,
+		pages:       pages,
+		animation:   animation,
 	}
-	return res, errors.Wrap(err, "cannot decode image")
+	return res, nil
 }
 
-func (*nativeImageHandler) Sharpen(_ any, _ string) error {
-	return errors.New("not implemented")
+func (ni *nativeImageHandler) Sharpen(imgAny Image, sigma string) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		return newFloatImage(img).unsharpMask(sig, 1.0).image(), nil
+	})
 }
 
-var sizeRegexp = regexp.MustCompile(`(\d+)x(\d+)`)
+func (ni *nativeImageHandler) Blur(imgAny Image, sigma string) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		return newFloatImage(img).blur(sig).image(), nil
+	})
+}
 
-func (ni *nativeImageHandler) Resize(imgAny any, size string, resizeType ResizeType) error {
-	nImg, ok := imgAny.(*nativeImage)
-	if !ok {
-		return errors.Errorf("cannot convert %T to *nativeImage", imgAny)
+func (ni *nativeImageHandler) Resize(imgAny Image, size string, resizeType ResizeType, anchor CropAnchor, background color.NRGBA, upscale bool, filter Filter) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
 	}
 	img := nImg.img
 	rect := img.Bounds()
-	sizeParts := sizeRegexp.FindStringSubmatch(size)
-	if len(sizeParts) != 3 {
-		return errors.Errorf("invalid size format '%s'", size)
+	scaled, box, err := resizeGeometry(rect.Dx(), rect.Dy(), size, resizeType, upscale)
+	if err != nil {
+		return err
+	}
+	if resizeType == ResizeTypeSmartCrop {
+		anchor = smartCropAnchor(nImg.img, box.Width, box.Height)
+		resizeType = ResizeTypeCrop
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		i := nativeResize(img, scaled.Width, scaled.Height, filter)
+		switch resizeType {
+		case ResizeTypePad:
+			return pad(i, box.Width, box.Height, anchor, background), nil
+		case ResizeTypeCrop:
+			x, y := anchor.Position(i.Bounds().Dx(), i.Bounds().Dy(), box.Width, box.Height)
+			cropped, err := cutter.Crop(i, cutter.Config{
+				Width:  box.Width,
+				Height: box.Height,
+				Anchor: image.Point{X: i.Bounds().Min.X + x, Y: i.Bounds().Min.Y + y},
+				Mode:   cutter.TopLeft,
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot crop image(%dx%d) to %dx%d", scaled.Width, scaled.Height, box.Width, box.Height)
+			}
+			return cropped, nil
+		}
+		return i, nil
+	})
+}
+
+// nativeFilters maps the filters to nfnt/resize, its bicubic filter is Catmull-Rom
+var nativeFilters = map[Filter]resize.InterpolationFunction{
+	FilterLanczos:  resize.Lanczos3,
+	FilterMitchell: resize.MitchellNetravali,
+	FilterCatrom:   resize.Bicubic,
+	FilterNearest:  resize.NearestNeighbor,
+	FilterTriangle: resize.Bilinear,
+}
+
+// boxKernel averages the source pixels covered by a target pixel
+var boxKernel = &xdraw.Kernel{Support: 0.5, At: func(float64) float64 { return 1 }}
+
+// nativeResize scales img to width x height, nfnt/resize has no box filter
+func nativeResize(img image.Image, width, height int, filter Filter) image.Image {
+	if filter != FilterBox {
+		return resize.Resize(uint(width), uint(height), img, nativeFilters[filter])
+	}
+	rect := image.Rect(0, 0, width, height)
+	var dst draw.Image = image.NewNRGBA(rect)
+	if isDeep(img) {
+		dst = image.NewNRGBA64(rect)
+	}
+	boxKernel.Scale(dst, rect, img, img.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+// pad places img within a width x height canvas filled with background
+func pad(img image.Image, width, height int, anchor CropAnchor, background color.NRGBA) image.Image {
+	rect := image.Rect(0, 0, width, height)
+	var canvas draw.Image = image.NewNRGBA(rect)
+	if isDeep(img) {
+		canvas = image.NewNRGBA64(rect)
 	}
-	width, err := strconv.Atoi(sizeParts[1])
+	draw.Draw(canvas, rect, image.NewUniform(background), image.Point{}, draw.Src)
+	x, y := anchor.Position(width, height, img.Bounds().Dx(), img.Bounds().Dy())
+	draw.Draw(canvas, image.Rect(x, y, x+img.Bounds().Dx(), y+img.Bounds().Dy()), img, img.Bounds().Min, draw.Src)
+	return canvas
+}
+
+func (ni *nativeImageHandler) Crop(imgAny Image, x, y, width, height int) error {
+	nImg, err := toNativeImage(imgAny)
 	if err != nil {
-		return errors.Wrapf(err, "invalid width '%s'", sizeParts[1])
+		return err
+	}
+	if err := checkCrop(nImg, x, y, width, height); err != nil {
+		return err
 	}
-	height, err := strconv.Atoi(sizeParts[2])
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		cropped, err := cutter.Crop(img, cutter.Config{
+			Width:  width,
+			Height: height,
+			Anchor: image.Point{X: x, Y: y},
+			Mode:   cutter.TopLeft,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot crop image to %dx%d+%d+%d", width, height, x, y)
+		}
+		return cropped, nil
+	})
+}
+
+func (ni *nativeImageHandler) Rotate(imgAny Image, degrees float64, background color.NRGBA) error {
+	nImg, err := toNativeImage(imgAny)
 	if err != nil {
-		return errors.Wrapf(err, "invalid height '%s'", sizeParts[2])
+		return err
 	}
+	if turns, ok := quarterTurns(degrees); ok {
+		if turns == 0 {
+			return nil
+		}
+		return nImg.each(func(img image.Image) (image.Image, error) {
+			return newFloatImage(img).rotateQuarter(turns).image(), nil
+		})
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		return newFloatImage(img).rotate(normalizeDegrees(degrees), background).image(), nil
+	})
+}
 
-	var newWidth, newHeight uint
-	switch resizeType {
-	case ResizeTypeAspect:
-		rectAspect := rect.Dx() / rect.Dy()
-		thumbAspect := int(width) / int(height)
-		newHeight = uint(height)
-		newWidth = uint(width)
-		if rectAspect > thumbAspect {
-			newHeight = uint(rect.Dy() * width / rect.Dx())
-		} else {
-			newWidth = uint(rect.Dx() * height / rect.Dy())
-		}
-	case ResizeTypeStretch:
-		newWidth = uint(width)
-		newHeight = uint(height)
-	case ResizeTypeCrop:
-		rectAspect := rect.Dx() / rect.Dy()
-		thumbAspect := int(width) / int(height)
-		newHeight = uint(height)
-		newWidth = uint(width)
-		if rectAspect < thumbAspect {
-			newHeight = uint(rect.Dy() * width / rect.Dx())
-		} else {
-			newWidth = uint(rect.Dx() * height / rect.Dy())
+func (ni *nativeImageHandler) Mirror(imgAny Image) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		return newFloatImage(img).mirror().image(), nil
+	})
+}
+
+func (ni *nativeImageHandler) Composite(imgAny, overlayAny Image, x, y int, opacity float64) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
+	}
+	overlay, err := toNativeImage(overlayAny)
+	if err != nil {
+		return err
+	}
+	if err := checkOpacity(opacity); err != nil {
+		return err
+	}
+	src := overlay.img.Bounds()
+	mask := image.NewUniform(color.Alpha16{A: uint16(opacity * 0xffff)})
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		rect := img.Bounds()
+		var dst draw.Image = image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+		if isDeep(img) {
+			dst = image.NewRGBA64(dst.Bounds())
 		}
-	default:
-		return errors.Errorf("unsupported resize type %d", resizeType)
+		draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+		draw.DrawMask(dst, image.Rect(x, y, x+src.Dx(), y+src.Dy()), overlay.img, src.Min, mask, image.Point{}, draw.Over)
+		return dst, nil
+	})
+}
+
+func (ni *nativeImageHandler) AutoOrient(imgAny Image) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
 	}
-	nImg.img = resize.Resize(newWidth, newHeight, img, resize.Lanczos3)
-	i, ok := nImg.img.(image.Image)
+	transform, ok := orientationTransforms[nImg.orientation]
 	if !ok {
-		return errors.Errorf("cannot convert %T to image.Image", imgAny)
+		return nil
 	}
-	if resizeType == ResizeTypeCrop {
-		nImg.img, err = cutter.Crop(i, cutter.Config{
-			Width:  int(width),
-			Height: int(height),
-			Mode:   cutter.Centered,
-		})
-		if err != nil {
-			return errors.Wrapf(err, "cannot crop image(%dx%d) to %dx%d", newWidth, newHeight, width, height)
-		}
+	fi := newFloatImage(nImg.img)
+	if transform.mirror {
+		fi = fi.mirror()
 	}
+	nImg.img = fi.rotateQuarter(transform.turns).image()
+	nImg.orientation = 1
 	return nil
 }
 
-func (ni *nativeImageHandler) Encode(imgAny any, writer io.Writer, format, compress, tile string) (uint64, string, error) {
-	nImg, ok := imgAny.(*nativeImage)
-	if !ok {
-		return 0, "", errors.Errorf("cannot convert %T to *nativeImage", imgAny)
+// ConvertColorSpace converts to gray and bitonal only, the go encoders cannot write cmyk or lab
+func (ni *nativeImageHandler) ConvertColorSpace(imgAny Image, colorSpace ColorSpace, threshold float64, dither bool) error {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := checkThreshold(threshold); err != nil {
+		return err
+	}
+	if colorSpace != ColorSpaceGray && colorSpace != ColorSpaceBitonal {
+		return errors.Wrapf(ErrNotSupported, "colour space %s", colorSpace)
+	}
+	return nImg.each(func(img image.Image) (image.Image, error) {
+		rect := image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())
+		var gray draw.Image = image.NewGray(rect)
+		if isDeep(img) {
+			gray = image.NewGray16(rect)
+		}
+		draw.Draw(gray, rect, img, img.Bounds().Min, draw.Src)
+		if colorSpace == ColorSpaceGray {
+			return gray, nil
+		}
+		// png writes a two colour palette with 1 bit per pixel
+		bitonal := image.NewPaletted(rect, color.Palette{color.Black, color.White})
+		if dither {
+			draw.FloydSteinberg.Draw(bitonal, rect, gray, image.Point{})
+			return bitonal, nil
+		}
+		limit := uint32(threshold * 0xffff)
+		for y := 0; y < rect.Dy(); y++ {
+			for x := 0; x < rect.Dx(); x++ {
+				if v, _, _, _ := gray.At(x, y).RGBA(); v >= limit {
+					bitonal.SetColorIndex(x, y, 1)
+				}
+			}
+		}
+		return bitonal, nil
+	})
+}
+
+// TransformColorProfile is not supported, the go decoders drop embedded profiles
+func (ni *nativeImageHandler) TransformColorProfile(imgAny Image, target, fallback []byte) error {
+	if _, err := toNativeImage(imgAny); err != nil {
+		return err
+	}
+	return errors.Wrap(ErrNotSupported, "color management")
+}
+
+// StripColorProfile does nothing, the go encoders never embed a profile
+func (ni *nativeImageHandler) StripColorProfile(imgAny Image) error {
+	_, err := toNativeImage(imgAny)
+	return err
+}
+
+// jpegMetadataSegments lists the APPn segments which are carried over from jpeg sources
+var jpegMetadataSegments = []struct {
+	marker byte
+	prefix string
+}{
+	{marker: 0xe1, prefix: "Exif\x00\x00"},
+	{marker: 0xe1, prefix: "http://ns.adobe.com/xap/1.0/\x00"},
+	{marker: 0xed, prefix: "Photoshop 3.0\x00"},
+}
+
+// headSegments returns copies of the metadata segments of a jpeg head, including their prefix
+func headSegments(head []byte) []jpegAPP {
+	if !bytes.HasPrefix(head, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	var segments []jpegAPP
+	for _, s := range jpegMetadataSegments {
+		if data := jpegSegment(head, s.marker, s.prefix); data != nil {
+			segments = append(segments, jpegAPP{marker: s.marker, data: append([]byte(s.prefix), data...)})
+		}
+	}
+	return segments
+}
+
+// headMetadata extracts the metadata of the first bytes of jpeg or tiff data.
+// Only the exif ifd0 of tiff files is read, if it is within the head.
+func headMetadata(head []byte) *Metadata {
+	if !bytes.HasPrefix(head, []byte{0xff, 0xd8}) {
+		return newMetadata(head, nil, nil, nil)
+	}
+	// icc profiles larger than one segment are not supported, the 2 bytes are the chunk number and count
+	icc := jpegSegment(head, 0xe2, "ICC_PROFILE\x00")
+	if len(icc) < 2 || icc[1] != 1 {
+		icc = nil
+	} else {
+		icc = icc[2:]
+	}
+	return newMetadata(
+		jpegSegment(head, 0xe1, "Exif\x00\x00"),
+		jpegSegment(head, 0xed, "Photoshop 3.0\x00"),
+		jpegSegment(head, 0xe1, "http://ns.adobe.com/xap/1.0/\x00"),
+		icc,
+	)
+}
+
+func (ni *nativeImageHandler) Metadata(imgAny Image) (*Metadata, error) {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return nil, err
+	}
+	return nImg.metadata, nil
+}
+
+func (ni *nativeImageHandler) Encode(imgAny Image, writer io.Writer, format, compress string, quality int, depth Depth, tile string, metadata MetadataPolicy) (uint64, string, error) {
+	nImg, err := toNativeImage(imgAny)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := checkDepth(format, depth); err != nil {
+		return 0, "", err
+	}
+	img, err := nativeDepth(nImg.img, depth)
+	if err != nil {
+		return 0, "", err
 	}
-	img := nImg.img
 	var mimetype string
 	out := NewCounterWriter(writer)
-	var err error
 	switch strings.ToLower(format) {
-	case "jpeg":
-		err = jpeg.Encode(out, img, nil)
+	case "jp2", "ptif":
+		return 0, "", errors.Wrapf(ErrNotSupported, "format %s, use the imagick or vips build", format)
+	case "jpeg", "jpg":
+		opts := &jpeg.Options{Quality: jpeg.DefaultQuality}
+		if quality >= 0 && quality <= 100 {
+			opts.Quality = quality
+		}
+		err = encodeJPEG(out, img, opts, nImg.metadataSegments(metadata))
 		mimetype = "image/jpeg"
 	case "png":
 		err = png.Encode(out, img)
@@ -135,8 +502,28 @@ func (ni *nativeImageHandler) Encode(imgAny any, writer io.Writer, format, compr
 	case "bmp":
 		err = bmp.Encode(out, img)
 		mimetype = "image/bmp"
-	case "tiff":
-		err = tiff.Encode(out, img, nil)
+	case "gif":
+		if nImg.animation != nil {
+			frames := append([]image.Image{img}, nImg.animation.frames...)
+			err = encodeGIF(out, frames, nImg.animation.delays, nImg.animation.loopCount)
+		} else {
+			err = gif.Encode(out, img, nil)
+		}
+		mimetype = "image/gif"
+	case "tiff", "tif":
+		// without compress the tiff is written uncompressed
+		var opts *tiff.Options
+		if compress != "" {
+			compression, ok := compresionNames[compress]
+			if !ok {
+				if slices.Contains(unsupportedCompressions, compress) {
+					return 0, "", errors.Wrapf(ErrNotSupported, "compression %s, use the imagick or vips build", compress)
+				}
+				return 0, "", errors.Errorf("unsupported compression '%s'", compress)
+			}
+			opts = &tiff.Options{Compression: compression}
+		}
+		err = tiff.Encode(out, img, opts)
 		mimetype = "image/tiff"
 	default:
 		return 0, "", errors.Errorf("unsupported format %s", format)
@@ -147,26 +534,98 @@ func (ni *nativeImageHandler) Encode(imgAny any, writer io.Writer, format, compr
 	return out.Bytes(), mimetype, nil
 }
 
-func (ni *nativeImageHandler) GetDimension(imgAny any) (int, int) {
-	nImg, ok := imgAny.(*nativeImage)
-	if !ok {
-		return 0, 0
+// nativeDepth converts img to 8 or 16 bit per sample, gray images stay gray
+func nativeDepth(img image.Image, depth Depth) (image.Image, error) {
+	gray := img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model
+	var dst draw.Image
+	switch {
+	case depth == Depth32F:
+		return nil, errors.Wrap(ErrNotSupported, "floating point samples")
+	case depth == Depth8 && isDeep(img) && gray:
+		dst = image.NewGray(img.Bounds())
+	case depth == Depth8 && isDeep(img):
+		dst = image.NewNRGBA(img.Bounds())
+	case depth == Depth16 && !isDeep(img) && gray:
+		dst = image.NewGray16(img.Bounds())
+	case depth == Depth16 && !isDeep(img):
+		dst = image.NewNRGBA64(img.Bounds())
+	default:
+		return img, nil
 	}
-	img := nImg.img
-	return img.Bounds().Dx(), img.Bounds().Dy()
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst, nil
 }
 
-func (ni *nativeImageHandler) Release(imgAny any) error {
-	nImg, ok := imgAny.(*nativeImage)
-	if !ok {
-		return errors.Errorf("cannot convert %T to *nativeImage", imgAny)
+// metadataSegments returns the jpeg segments to write for policy
+func (nImg *nativeImage) metadataSegments(policy MetadataPolicy) []jpegAPP {
+	switch policy {
+	case MetadataKeep:
+		segments := make([]jpegAPP, 0, len(nImg.segments))
+		for _, s := range nImg.segments {
+			// the pixels have been oriented, a kept orientation would turn them again
+			if nImg.orientation == 1 && bytes.HasPrefix(s.data, []byte("Exif\x00\x00")) {
+				s.data = exifResetOrientation(s.data)
+			}
+			segments = append(segments, s)
+		}
+		return segments
+	case MetadataRightsOnly:
+		r := nImg.metadata.rights()
+		var segments []jpegAPP
+		if exif := r.exif(); exif != nil {
+			segments = append(segments, jpegAPP{marker: 0xe1, data: exif})
+		}
+		if xmp := r.xmp(); xmp != nil {
+			segments = append(segments, jpegAPP{marker: 0xe1, data: append([]byte("http://ns.adobe.com/xap/1.0/\x00"), xmp...)})
+		}
+		return segments
 	}
-	nImg.img = nil
 	return nil
 }
 
+// encodeJPEG encodes img and inserts segments after the start of image marker
+func encodeJPEG(out io.Writer, img image.Image, opts *jpeg.Options, segments []jpegAPP) error {
+	if len(segments) == 0 {
+		return jpeg.Encode(out, img, opts)
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, opts); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if _, err := out.Write(data[:2]); err != nil {
+		return err
+	}
+	for _, s := range segments {
+		// the segment length includes the two length bytes
+		if len(s.data)+2 > math.MaxUint16 {
+			continue
+		}
+		header := []byte{0xff, s.marker, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(s.data)+2))
+		if _, err := out.Write(append(header, s.data...)); err != nil {
+			return err
+		}
+	}
+	_, err := out.Write(data[2:])
+	return err
+}
+
 func (ni *nativeImageHandler) Close() error {
 	return nil
 }
 
+// toNativeImage returns the nativeImage behind imgAny or an error if it has already been closed
+func toNativeImage(imgAny Image) (*nativeImage, error) {
+	img, ok := imgAny.(*nativeImage)
+	if !ok {
+		return nil, errors.Errorf("cannot convert %T to *nativeImage", imgAny)
+	}
+	if img.img == nil {
+		return nil, errors.New("image has already been closed")
+	}
+	return img, nil
+}
+
 var _ ImageHandler = &nativeImageHandler{}
+var _ Image = &nativeImage{}
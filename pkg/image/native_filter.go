@@ -0,0 +1,209 @@
+//go:build (!(imagick && !vips) && !(!imagick && vips)) || !cgo
+
+package image
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// floatImage holds premultiplied rgba samples in the range 0..0xffff,
+// gray images hold a single channel without alpha and stay gray
+type floatImage struct {
+	pix    [][]float32
+	width  int
+	height int
+	deep   bool
+}
+
+// gray reports whether fi holds a single gray channel
+func (fi *floatImage) gray() bool {
+	return len(fi.pix) == 1
+}
+
+// allocFloatImage returns a black image with channels of width x height samples
+func allocFloatImage(width, height, channels int, deep bool) *floatImage {
+	res := &floatImage{width: width, height: height, deep: deep, pix: make([][]float32, channels)}
+	for c := range res.pix {
+		res.pix[c] = make([]float32, width*height)
+	}
+	return res
+}
+
+// rgba expands a gray image to opaque rgba
+func (fi *floatImage) rgba() *floatImage {
+	if !fi.gray() {
+		return fi
+	}
+	res := allocFloatImage(fi.width, fi.height, 4, fi.deep)
+	for c := 0; c < 3; c++ {
+		copy(res.pix[c], fi.pix[0])
+	}
+	for i := range res.pix[3] {
+		res.pix[3][i] = 0xffff
+	}
+	return res
+}
+
+// isDeep reports whether img carries more than 8 bits per sample
+func isDeep(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// newFloatImage converts img row by row, only the float samples are held in full
+func newFloatImage(img image.Image) *floatImage {
+	rect := img.Bounds()
+	width, height := rect.Dx(), rect.Dy()
+	switch src := img.(type) {
+	case *image.Gray:
+		fi := allocFloatImage(width, height, 1, false)
+		for y := 0; y < height; y++ {
+			row := src.Pix[src.PixOffset(rect.Min.X, rect.Min.Y+y):]
+			for x := 0; x < width; x++ {
+				fi.pix[0][y*width+x] = float32(row[x]) * 0x101
+			}
+		}
+		return fi
+	case *image.Gray16:
+		fi := allocFloatImage(width, height, 1, true)
+		for y := 0; y < height; y++ {
+			row := src.Pix[src.PixOffset(rect.Min.X, rect.Min.Y+y):]
+			for x := 0; x < width; x++ {
+				fi.pix[0][y*width+x] = float32(uint16(row[x*2])<<8 | uint16(row[x*2+1]))
+			}
+		}
+		return fi
+	}
+	fi := allocFloatImage(width, height, 4, isDeep(img))
+	line := image.NewRGBA64(image.Rect(0, 0, width, 1))
+	for y := 0; y < height; y++ {
+		draw.Draw(line, line.Bounds(), img, image.Pt(rect.Min.X, rect.Min.Y+y), draw.Src)
+		for x := 0; x < width; x++ {
+			for c := 0; c < 4; c++ {
+				fi.pix[c][y*width+x] = float32(uint16(line.Pix[x*8+c*2])<<8 | uint16(line.Pix[x*8+c*2+1]))
+			}
+		}
+	}
+	return fi
+}
+
+// image converts back to an 8 or 16 bit gray or rgba image depending on the source
+func (fi *floatImage) image() image.Image {
+	clamp := func(v float32) uint16 {
+		if v <= 0 {
+			return 0
+		}
+		if v >= 0xffff {
+			return 0xffff
+		}
+		return uint16(v + 0.5)
+	}
+	rect := image.Rect(0, 0, fi.width, fi.height)
+	if fi.gray() {
+		if fi.deep {
+			out := image.NewGray16(rect)
+			for i, v := range fi.pix[0] {
+				out.Pix[i*2] = uint8(clamp(v) >> 8)
+				out.Pix[i*2+1] = uint8(clamp(v))
+			}
+			return out
+		}
+		out := image.NewGray(rect)
+		for i, v := range fi.pix[0] {
+			out.Pix[i] = uint8(clamp(v) >> 8)
+		}
+		return out
+	}
+	if fi.deep {
+		out := image.NewRGBA64(rect)
+		for i := 0; i < fi.width*fi.height; i++ {
+			a := clamp(fi.pix[3][i])
+			for c := 0; c < 4; c++ {
+				v := min(clamp(fi.pix[c][i]), a)
+				out.Pix[i*8+c*2] = uint8(v >> 8)
+				out.Pix[i*8+c*2+1] = uint8(v)
+			}
+		}
+		return out
+	}
+	out := image.NewRGBA(rect)
+	for i := 0; i < fi.width*fi.height; i++ {
+		a := clamp(fi.pix[3][i])
+		for c := 0; c < 4; c++ {
+			out.Pix[i*4+c] = uint8(min(clamp(fi.pix[c][i]), a) >> 8)
+		}
+	}
+	return out
+}
+
+// gaussianKernel returns a normalized one dimensional kernel with a radius of 3 sigma
+func gaussianKernel(sigma float64) []float32 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float32, 2*radius+1)
+	var sum float64
+	for i := -radius; i <= radius; i++ {
+		v := math.Exp(-float64(i*i) / (2 * sigma * sigma))
+		kernel[i+radius] = float32(v)
+		sum += v
+	}
+	for i := range kernel {
+		kernel[i] /= float32(sum)
+	}
+	return kernel
+}
+
+// blur applies a separable gaussian blur, edge pixels are extended
+func (fi *floatImage) blur(sigma float64) *floatImage {
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+	res := &floatImage{width: fi.width, height: fi.height, deep: fi.deep, pix: make([][]float32, len(fi.pix))}
+	tmp := make([]float32, fi.width*fi.height)
+	for c, src := range fi.pix {
+		for y := 0; y < fi.height; y++ {
+			row := y * fi.width
+			for x := 0; x < fi.width; x++ {
+				var v float32
+				for k, w := range kernel {
+					sx := min(max(x+k-radius, 0), fi.width-1)
+					v += src[row+sx] * w
+				}
+				tmp[row+x] = v
+			}
+		}
+		dst := make([]float32, fi.width*fi.height)
+		for y := 0; y < fi.height; y++ {
+			for x := 0; x < fi.width; x++ {
+				var v float32
+				for k, w := range kernel {
+					sy := min(max(y+k-radius, 0), fi.height-1)
+					v += tmp[sy*fi.width+x] * w
+				}
+				dst[y*fi.width+x] = v
+			}
+		}
+		res.pix[c] = dst
+	}
+	return res
+}
+
+// unsharpMask adds amount times the difference between the image and its blurred version
+func (fi *floatImage) unsharpMask(sigma, amount float64) *floatImage {
+	blurred := fi.blur(sigma)
+	for c, src := range fi.pix {
+		// alpha is kept
+		if c == 3 {
+			copy(blurred.pix[c], src)
+			continue
+		}
+		for i, v := range src {
+			blurred.pix[c][i] = v + float32(amount)*(v-blurred.pix[c][i])
+		}
+	}
+	return blurred
+}
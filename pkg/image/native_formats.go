@@ -0,0 +1,15 @@
+//go:build (!(imagick && !vips) && !(!imagick && vips)) || !cgo
+
+package image
+
+import "golang.org/x/image/tiff"
+
+// compresionNames are the tiff compressions the go encoder writes
+var compresionNames = map[string]tiff.CompressionType{
+	"no":      tiff.Uncompressed,
+	"zip":     tiff.Deflate,
+	"deflate": tiff.Deflate,
+}
+
+// unsupportedCompressions are known to the other backends but cannot be written by the go encoder
+var unsupportedCompressions = []string{"lzw", "group4", "jpeg", "rle"}
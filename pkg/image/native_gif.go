@@ -0,0 +1,106 @@
+//go:build (!(imagick && !vips) && !(!imagick && vips)) || !cgo
+
+package image
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// nativeAnimation holds the frames of an animation following the first one
+type nativeAnimation struct {
+	frames []image.Image
+	// delays of all frames in 100ths of a second
+	delays    []int
+	loopCount int
+}
+
+// gifFrames renders the frames of g up to last onto the logical screen, honouring their disposal
+func gifFrames(g *gif.GIF, last int) []image.Image {
+	rect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewNRGBA(rect)
+	frames := make([]image.Image, 0, last+1)
+	for i := 0; i <= last; i++ {
+		frame := g.Image[i]
+		var previous *image.NRGBA
+		if i < len(g.Disposal) && g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(rect)
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		rendered := image.NewNRGBA(rect)
+		copy(rendered.Pix, canvas.Pix)
+		frames = append(frames, rendered)
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+	return frames
+}
+
+// gifPalette is plan9 with a transparent entry instead of a light yellow
+var gifPalette = append(append(color.Palette{}, palette.Plan9[:254]...), palette.Plan9[255], color.Transparent)
+
+// encodeGIF writes frames as animation. The frames are mapped to the palette without dithering,
+// which would change from frame to frame. Opaque animations store only the changed area of each frame.
+func encodeGIF(out io.Writer, frames []image.Image, delays []int, loopCount int) error {
+	pal := color.Palette(palette.Plan9)
+	opaque := true
+	for _, frame := range frames {
+		if o, ok := frame.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			pal, opaque = gifPalette, false
+			break
+		}
+	}
+	rect := image.Rect(0, 0, frames[0].Bounds().Dx(), frames[0].Bounds().Dy())
+	anim := &gif.GIF{
+		LoopCount: loopCount,
+		Config:    image.Config{ColorModel: pal, Width: rect.Dx(), Height: rect.Dy()},
+	}
+	var previous *image.Paletted
+	for i, frame := range frames {
+		current := image.NewPaletted(rect, pal)
+		draw.Draw(current, rect, frame, frame.Bounds().Min, draw.Src)
+		block, disposal := current, byte(gif.DisposalBackground)
+		if opaque {
+			disposal = gif.DisposalNone
+			if previous != nil {
+				block = current.SubImage(changedRect(previous, current)).(*image.Paletted)
+			}
+		}
+		var delay int
+		if i < len(delays) {
+			delay = delays[i]
+		}
+		anim.Image = append(anim.Image, block)
+		anim.Delay = append(anim.Delay, delay)
+		anim.Disposal = append(anim.Disposal, disposal)
+		previous = current
+	}
+	return gif.EncodeAll(out, anim)
+}
+
+// changedRect returns the bounds of the pixels which differ between a and b, at least one pixel
+func changedRect(a, b *image.Paletted) image.Rectangle {
+	changed := image.Rectangle{}
+	for y := b.Rect.Min.Y; y < b.Rect.Max.Y; y++ {
+		for x := b.Rect.Min.X; x < b.Rect.Max.X; x++ {
+			if a.ColorIndexAt(x, y) != b.ColorIndexAt(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if changed.Empty() {
+		return image.Rect(b.Rect.Min.X, b.Rect.Min.Y, b.Rect.Min.X+1, b.Rect.Min.Y+1)
+	}
+	return changed
+}
@@ -0,0 +1,114 @@
+//go:build (!(imagick && !vips) && !(!imagick && vips)) || !cgo
+
+package image
+
+import (
+	"image/color"
+	"math"
+)
+
+// orientationTransforms maps exif orientations to a horizontal mirror followed by clockwise quarter turns
+var orientationTransforms = map[int]struct {
+	mirror bool
+	turns  int
+}{
+	2: {mirror: true},
+	3: {turns: 2},
+	4: {mirror: true, turns: 2},
+	5: {mirror: true, turns: 3},
+	6: {turns: 1},
+	7: {mirror: true, turns: 1},
+	8: {turns: 3},
+}
+
+// rotateQuarter turns the image clockwise by turns times 90 degrees without resampling
+func (fi *floatImage) rotateQuarter(turns int) *floatImage {
+	turns = ((turns % 4) + 4) % 4
+	if turns == 0 {
+		return fi
+	}
+	res := &floatImage{width: fi.width, height: fi.height, deep: fi.deep, pix: make([][]float32, len(fi.pix))}
+	if turns != 2 {
+		res.width, res.height = fi.height, fi.width
+	}
+	for c, src := range fi.pix {
+		dst := make([]float32, len(src))
+		for y := 0; y < res.height; y++ {
+			for x := 0; x < res.width; x++ {
+				var sx, sy int
+				switch turns {
+				case 1:
+					sx, sy = y, fi.height-1-x
+				case 2:
+					sx, sy = fi.width-1-x, fi.height-1-y
+				case 3:
+					sx, sy = fi.width-1-y, x
+				}
+				dst[y*res.width+x] = src[sy*fi.width+sx]
+			}
+		}
+		res.pix[c] = dst
+	}
+	return res
+}
+
+// rotate turns the image clockwise by degrees with bilinear sampling.
+// The result is enlarged to hold the whole image, uncovered areas get background.
+// Gray images stay gray unless the background is not opaque.
+func (fi *floatImage) rotate(degrees float64, background color.Color) *floatImage {
+	r, g, b, a := background.RGBA()
+	bg := []float32{float32(r), float32(g), float32(b), float32(a)}
+	if fi.gray() {
+		if a == 0xffff {
+			bg = []float32{float32(color.Gray16Model.Convert(background).(color.Gray16).Y)}
+		} else {
+			fi = fi.rgba()
+		}
+	}
+	theta := degrees * math.Pi / 180
+	sin, cos := math.Sincos(theta)
+	w, h := float64(fi.width), float64(fi.height)
+	// the epsilon keeps rounding errors from adding an empty row or column
+	res := allocFloatImage(
+		int(math.Ceil(math.Abs(w*cos)+math.Abs(h*sin)-1e-6)),
+		int(math.Ceil(math.Abs(w*sin)+math.Abs(h*cos)-1e-6)),
+		len(fi.pix),
+		fi.deep,
+	)
+	sample := func(c, x, y int) float32 {
+		if x < 0 || y < 0 || x >= fi.width || y >= fi.height {
+			return bg[c]
+		}
+		return fi.pix[c][y*fi.width+x]
+	}
+	for y := 0; y < res.height; y++ {
+		for x := 0; x < res.width; x++ {
+			// map the destination pixel center back into the source
+			dx := float64(x) + 0.5 - float64(res.width)/2
+			dy := float64(y) + 0.5 - float64(res.height)/2
+			sx := dx*cos + dy*sin + w/2 - 0.5
+			sy := -dx*sin + dy*cos + h/2 - 0.5
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			fx, fy := float32(sx-float64(x0)), float32(sy-float64(y0))
+			for c := range res.pix {
+				top := sample(c, x0, y0)*(1-fx) + sample(c, x0+1, y0)*fx
+				bottom := sample(c, x0, y0+1)*(1-fx) + sample(c, x0+1, y0+1)*fx
+				res.pix[c][y*res.width+x] = top*(1-fy) + bottom*fy
+			}
+		}
+	}
+	return res
+}
+
+// mirror flips the image horizontally
+func (fi *floatImage) mirror() *floatImage {
+	for c := range fi.pix {
+		for y := 0; y < fi.height; y++ {
+			row := fi.pix[c][y*fi.width : (y+1)*fi.width]
+			for i, j := 0, len(row)-1; i < j; i, j = i+1, j-1 {
+				row[i], row[j] = row[j], row[i]
+			}
+		}
+	}
+	return fi
+}
@@ -0,0 +1,64 @@
+//go:build (!(imagick && !vips) && !(!imagick && vips)) || !cgo
+
+package image
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"golang.org/x/image/tiff"
+	"testing"
+)
+
+func TestNativeTiffCompression(t *testing.T) {
+	tests := []struct {
+		compress string
+		// tag is the tiff compression tag, 1 is none and 8 is deflate
+		tag            uint16
+		wantErr        bool
+		wantNotSupport bool
+	}{
+		{compress: "", tag: 1},
+		{compress: "no", tag: 1},
+		{compress: "zip", tag: 8},
+		{compress: "deflate", tag: 8},
+		{compress: "lzw", wantErr: true, wantNotSupport: true},
+		{compress: "group4", wantErr: true, wantNotSupport: true},
+		{compress: "zips", wantErr: true},
+		{compress: "foo", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run("compress="+test.compress, func(t *testing.T) {
+			img := decodeFixture(t, testHandler, 64, 48)
+			out := &bytes.Buffer{}
+			_, _, err := testHandler.Encode(img, out, "tiff", test.compress, 0, DepthSource, "", MetadataKeep)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("compression '%s' accepted", test.compress)
+				}
+				if errors.Is(err, ErrNotSupported) != test.wantNotSupport {
+					t.Errorf("compression '%s': ErrNotSupported is %v, got %v", test.compress, test.wantNotSupport, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot encode with compression '%s': %v", test.compress, err)
+			}
+			if tag, _ := tiffTag(t, out.Bytes(), 259); tag != uint32(test.tag) {
+				t.Errorf("compression '%s' wrote tag %d, want %d", test.compress, tag, test.tag)
+			}
+			if _, err := tiff.Decode(bytes.NewReader(out.Bytes())); err != nil {
+				t.Errorf("cannot decode tiff with compression '%s': %v", test.compress, err)
+			}
+		})
+	}
+}
+
+func TestNativeCompressionNames(t *testing.T) {
+	// every name of the map must be written by the go encoder
+	for name := range compresionNames {
+		img := decodeFixture(t, testHandler, 16, 16)
+		if _, _, err := testHandler.Encode(img, &bytes.Buffer{}, "tiff", name, 0, DepthSource, "", MetadataKeep); err != nil {
+			t.Errorf("cannot encode with compression '%s': %v", name, err)
+		}
+	}
+}
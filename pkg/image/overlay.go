@@ -0,0 +1,38 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/geometry"
+	"math"
+)
+
+// checkOpacity verifies that opacity lies within 0 and 1
+func checkOpacity(opacity float64) error {
+	if math.IsNaN(opacity) || opacity < 0 || opacity > 1 {
+		return errors.Errorf("opacity %v not >= 0 and <= 1", opacity)
+	}
+	return nil
+}
+
+// OverlaySize returns the size of an overlay of overlayWidth x overlayHeight scaled to fit
+// into scale times width x height, keeping its aspect ratio. A scale of 0 keeps the size.
+func OverlaySize(width, height, overlayWidth, overlayHeight int, scale float64) (int, int, error) {
+	if overlayWidth <= 0 || overlayHeight <= 0 {
+		return 0, 0, errors.Errorf("invalid overlay size %dx%d", overlayWidth, overlayHeight)
+	}
+	if scale == 0 {
+		return overlayWidth, overlayHeight, nil
+	}
+	if math.IsNaN(scale) || scale < 0 || scale > 1 {
+		return 0, 0, errors.Errorf("scale %v not > 0 and <= 1", scale)
+	}
+	box := geometry.Size{
+		Width:  max(1, int(scale*float64(width))),
+		Height: max(1, int(scale*float64(height))),
+	}
+	fit, err := geometry.Fit(geometry.Size{Width: overlayWidth, Height: overlayHeight}, box)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "cannot fit overlay")
+	}
+	return fit.Width, fit.Height, nil
+}
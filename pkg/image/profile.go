@@ -0,0 +1,41 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// LoadColorProfiles reads all *.icc files of fsys.
+// The profiles are named by their lowercase file name without extension.
+func LoadColorProfiles(fsys fs.FS) (map[string][]byte, error) {
+	names, err := fs.Glob(fsys, "*.icc")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list icc profiles")
+	}
+	profiles := map[string][]byte{}
+	for _, name := range names {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read icc profile %s", name)
+		}
+		if err := checkColorProfile(data); err != nil {
+			return nil, errors.Wrapf(err, "invalid icc profile %s", name)
+		}
+		profiles[strings.ToLower(strings.TrimSuffix(name, path.Ext(name)))] = data
+	}
+	return profiles, nil
+}
+
+// checkColorProfile verifies the size and signature of the icc header
+func checkColorProfile(data []byte) error {
+	// the 128 byte header is followed by the tag count
+	if len(data) < 132 {
+		return errors.Errorf("profile too short (%d bytes)", len(data))
+	}
+	if string(data[36:40]) != "acsp" {
+		return errors.New("missing 'acsp' signature")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package image
+
+import (
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/configs"
+	"io/fs"
+	"testing"
+)
+
+func TestLoadColorProfiles(t *testing.T) {
+	iccFS, err := fs.Sub(configs.ICCFS, "icc")
+	if err != nil {
+		t.Fatalf("cannot open icc profiles: %v", err)
+	}
+	profiles, err := LoadColorProfiles(iccFS)
+	if err != nil {
+		t.Fatalf("cannot load icc profiles: %v", err)
+	}
+	for _, name := range []string{"srgb", "gray"} {
+		if _, ok := profiles[name]; !ok {
+			t.Errorf("profile %s not bundled", name)
+		}
+	}
+	if err := checkColorProfile([]byte("no profile")); err == nil {
+		t.Error("invalid profile accepted")
+	}
+}
@@ -0,0 +1,116 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"slices"
+	"strings"
+)
+
+// rawFormats are the camera raw formats read by DecodeRaw
+var rawFormats = []string{"3fr", "arw", "cr2", "cr3", "crw", "dcr", "dng", "erf", "kdc", "mef", "mrw", "nef", "nrw", "orf", "pef", "raf", "rw2", "sr2", "srf", "srw", "x3f"}
+
+// IsRawFormat reports whether format is a camera raw format
+func IsRawFormat(format string) bool {
+	return slices.Contains(rawFormats, strings.ToLower(format))
+}
+
+// WhiteBalance selects the white balance of a raw development
+type WhiteBalance int
+
+const (
+	// WhiteBalanceCamera uses the white balance recorded by the camera
+	WhiteBalanceCamera WhiteBalance = iota
+	// WhiteBalanceAuto averages the whole image
+	WhiteBalanceAuto
+	// WhiteBalanceNone keeps the daylight multipliers of the sensor
+	WhiteBalanceNone
+)
+
+var whiteBalanceNames = map[string]WhiteBalance{
+	"camera": WhiteBalanceCamera,
+	"auto":   WhiteBalanceAuto,
+	"none":   WhiteBalanceNone,
+}
+
+// ParseWhiteBalance parses "camera", "auto" or "none", empty is camera
+func ParseWhiteBalance(name string) (WhiteBalance, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return WhiteBalanceCamera, nil
+	}
+	whiteBalance, ok := whiteBalanceNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid white balance '%s'", name)
+	}
+	return whiteBalance, nil
+}
+
+// Demosaic is the interpolation of the colour filter array, slower ones give fewer artefacts
+type Demosaic int
+
+const (
+	// DemosaicAHD is adaptive homogeneity-directed interpolation
+	DemosaicAHD Demosaic = iota
+	DemosaicLinear
+	DemosaicVNG
+	DemosaicPPG
+	DemosaicDCB
+	DemosaicDHT
+)
+
+var demosaicNames = map[string]Demosaic{
+	"ahd":    DemosaicAHD,
+	"linear": DemosaicLinear,
+	"vng":    DemosaicVNG,
+	"ppg":    DemosaicPPG,
+	"dcb":    DemosaicDCB,
+	"dht":    DemosaicDHT,
+}
+
+// ParseDemosaic parses "ahd", "linear", "vng", "ppg", "dcb" or "dht", empty is ahd
+func ParseDemosaic(name string) (Demosaic, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return DemosaicAHD, nil
+	}
+	demosaic, ok := demosaicNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid demosaic '%s'", name)
+	}
+	return demosaic, nil
+}
+
+// RawColorSpace is the colour space of the developed pixels
+type RawColorSpace int
+
+const (
+	RawColorSpaceSRGB RawColorSpace = iota
+	RawColorSpaceAdobe
+	RawColorSpaceWide
+	RawColorSpaceProPhoto
+	RawColorSpaceXYZ
+	// RawColorSpaceRaw keeps the colours of the sensor
+	RawColorSpaceRaw
+)
+
+var rawColorSpaceNames = map[string]RawColorSpace{
+	"srgb":     RawColorSpaceSRGB,
+	"adobe":    RawColorSpaceAdobe,
+	"wide":     RawColorSpaceWide,
+	"prophoto": RawColorSpaceProPhoto,
+	"xyz":      RawColorSpaceXYZ,
+	"raw":      RawColorSpaceRaw,
+}
+
+// ParseRawColorSpace parses "srgb", "adobe", "wide", "prophoto", "xyz" or "raw", empty is srgb
+func ParseRawColorSpace(name string) (RawColorSpace, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return RawColorSpaceSRGB, nil
+	}
+	colorSpace, ok := rawColorSpaceNames[name]
+	if !ok {
+		return 0, errors.Errorf("invalid raw colour space '%s'", name)
+	}
+	return colorSpace, nil
+}
@@ -0,0 +1,32 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseRawOptions(t *testing.T) {
+	if wb, err := ParseWhiteBalance(""); err != nil || wb != WhiteBalanceCamera {
+		t.Errorf("empty white balance: got %v, %v", wb, err)
+	}
+	if wb, err := ParseWhiteBalance("Auto"); err != nil || wb != WhiteBalanceAuto {
+		t.Errorf("white balance auto: got %v, %v", wb, err)
+	}
+	if demosaic, err := ParseDemosaic(""); err != nil || demosaic != DemosaicAHD {
+		t.Errorf("empty demosaic: got %v, %v", demosaic, err)
+	}
+	if colorSpace, err := ParseRawColorSpace("prophoto"); err != nil || colorSpace != RawColorSpaceProPhoto {
+		t.Errorf("raw colour space prophoto: got %v, %v", colorSpace, err)
+	}
+	if _, err := ParseWhiteBalance("tungsten"); err == nil {
+		t.Error("white balance 'tungsten' succeeded")
+	}
+	if _, err := ParseDemosaic("amaze"); err == nil {
+		t.Error("demosaic 'amaze' succeeded")
+	}
+	if _, err := ParseRawColorSpace("cmyk"); err == nil {
+		t.Error("raw colour space 'cmyk' succeeded")
+	}
+	if !IsRawFormat("NEF") || IsRawFormat("tiff") {
+		t.Error("IsRawFormat does not match nef and tiff")
+	}
+}
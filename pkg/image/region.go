@@ -0,0 +1,74 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var regionRegexp = regexp.MustCompile(`^(pct:)?([0-9.]+),([0-9.]+),([0-9.]+),([0-9.]+)$`)
+
+// ParseRegion resolves an IIIF region ("full", "square", "x,y,w,h" or "pct:x,y,w,h")
+// to pixel coordinates within an image of width x height.
+// Regions reaching beyond the image are clipped, regions without overlap are an error.
+func ParseRegion(region string, width, height int) (x, y, w, h int, err error) {
+	if width <= 0 || height <= 0 {
+		return 0, 0, 0, 0, errors.Errorf("invalid image size %dx%d", width, height)
+	}
+	region = strings.ToLower(strings.TrimSpace(region))
+	switch region {
+	case "full":
+		return 0, 0, width, height, nil
+	case "square":
+		side := min(width, height)
+		return (width - side) / 2, (height - side) / 2, side, side, nil
+	}
+	parts := regionRegexp.FindStringSubmatch(region)
+	if parts == nil {
+		return 0, 0, 0, 0, errors.Errorf("invalid region format '%s'", region)
+	}
+	var values [4]float64
+	for i, part := range parts[2:] {
+		values[i], err = strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, 0, 0, 0, errors.Wrapf(err, "invalid region value '%s'", part)
+		}
+	}
+	if parts[1] != "" {
+		values[0] = values[0] * float64(width) / 100
+		values[1] = values[1] * float64(height) / 100
+		values[2] = values[2] * float64(width) / 100
+		values[3] = values[3] * float64(height) / 100
+	}
+	// larger values are clipped or outside anyway, the conversion to int would overflow
+	for i := range values {
+		values[i] = min(values[i], math.MaxInt32)
+	}
+	x = int(math.Round(values[0]))
+	y = int(math.Round(values[1]))
+	w = int(math.Round(values[2]))
+	h = int(math.Round(values[3]))
+	if w <= 0 || h <= 0 {
+		return 0, 0, 0, 0, errors.Errorf("empty region '%s'", region)
+	}
+	if x >= width || y >= height {
+		return 0, 0, 0, 0, errors.Errorf("region '%s' is outside of image %dx%d", region, width, height)
+	}
+	w = min(w, width-x)
+	h = min(h, height-y)
+	return x, y, w, h, nil
+}
+
+// checkCrop verifies that the area x, y, width x height lies within img
+func checkCrop(img Image, x, y, width, height int) error {
+	w, h := img.Dimensions()
+	if width <= 0 || height <= 0 {
+		return errors.Errorf("invalid crop size %dx%d", width, height)
+	}
+	if x < 0 || y < 0 || x+width > w || y+height > h {
+		return errors.Errorf("crop area %dx%d+%d+%d is outside of image %dx%d", width, height, x, y, w, h)
+	}
+	return nil
+}
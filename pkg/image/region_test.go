@@ -0,0 +1,38 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRegion(t *testing.T) {
+	huge := "1" + strings.Repeat("0", 300)
+	tests := []struct {
+		region     string
+		x, y, w, h int
+	}{
+		{"full", 0, 0, 400, 200},
+		{"square", 100, 0, 200, 200},
+		{"10,20,30,40", 10, 20, 30, 40},
+		{"350,150,100,100", 350, 150, 50, 50},
+		{"pct:25,50,50,50", 100, 100, 200, 100},
+		{"pct:12.5,0,10,100", 50, 0, 40, 200},
+		{"10,20," + huge + "," + huge, 10, 20, 390, 180},
+		{"pct:0,0," + huge + ",100", 0, 0, 400, 200},
+	}
+	for _, tt := range tests {
+		x, y, w, h, err := ParseRegion(tt.region, 400, 200)
+		if err != nil {
+			t.Errorf("%s: %v", tt.region, err)
+			continue
+		}
+		if x != tt.x || y != tt.y || w != tt.w || h != tt.h {
+			t.Errorf("%s: got %d,%d,%d,%d, want %d,%d,%d,%d", tt.region, x, y, w, h, tt.x, tt.y, tt.w, tt.h)
+		}
+	}
+	for _, region := range []string{"", "10,20,30", "10,20,0,40", "400,0,10,10", "pct:a,b,c,d", "-1,0,10,10", "1e300,0,10,10", huge + ",0,10,10", "0," + huge + ",10,10", "pct:" + huge + ",0,10,10"} {
+		if _, _, _, _, err := ParseRegion(region, 400, 200); err == nil {
+			t.Errorf("region '%s' succeeded", region)
+		}
+	}
+}
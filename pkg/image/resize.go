@@ -0,0 +1,80 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/geometry"
+	"regexp"
+	"strconv"
+)
+
+var sizeRegexp = regexp.MustCompile(`(\d+)x(\d+)`)
+
+// resizeGeometry returns the size an image of cols x rows is scaled to and the box of crop and pad resizes.
+// All backends use it, so they produce the same sizes.
+// Without upscale the scaled size never exceeds the image.
+func resizeGeometry(cols, rows int, size string, resizeType ResizeType, upscale bool) (scaled, box geometry.Size, err error) {
+	if cols == 0 || rows == 0 {
+		return scaled, box, errors.New("image size is 0")
+	}
+	sizeParts := sizeRegexp.FindStringSubmatch(size)
+	if len(sizeParts) != 3 {
+		return scaled, box, errors.Errorf("invalid size format '%s'", size)
+	}
+	if box.Width, err = strconv.Atoi(sizeParts[1]); err != nil {
+		return scaled, box, errors.Wrapf(err, "invalid width '%s'", sizeParts[1])
+	}
+	if box.Height, err = strconv.Atoi(sizeParts[2]); err != nil {
+		return scaled, box, errors.Wrapf(err, "invalid height '%s'", sizeParts[2])
+	}
+	if box.Width == 0 && box.Height == 0 {
+		return scaled, box, errors.New("both width and height are 0")
+	}
+	src := geometry.Size{Width: cols, Height: rows}
+	needBox := func(name string) error {
+		if box.Width == 0 || box.Height == 0 {
+			return errors.Errorf("both width and height must be set for %s resize", name)
+		}
+		return nil
+	}
+	switch resizeType {
+	case ResizeTypeAspect:
+		scaled, err = geometry.Fit(src, box)
+	case ResizeTypeStretch:
+		if err = needBox("stretch"); err == nil {
+			scaled = box
+		}
+	case ResizeTypeCrop, ResizeTypeSmartCrop:
+		name := "crop"
+		if resizeType == ResizeTypeSmartCrop {
+			name = "smartcrop"
+		}
+		if err = needBox(name); err == nil {
+			scaled, err = geometry.Fill(src, box)
+			box = geometry.CropBox(scaled, box)
+		}
+	case ResizeTypePad:
+		if err = needBox("pad"); err == nil {
+			scaled, err = geometry.Fit(src, box)
+		}
+	default:
+		return scaled, box, errors.Errorf("unsupported resize type %d", resizeType)
+	}
+	if err != nil || upscale {
+		return scaled, box, err
+	}
+	switch resizeType {
+	case ResizeTypeStretch:
+		scaled = geometry.Size{Width: min(scaled.Width, cols), Height: min(scaled.Height, rows)}
+	case ResizeTypeAspect, ResizeTypePad:
+		if !src.Contains(scaled) {
+			scaled = src
+		}
+	case ResizeTypeCrop, ResizeTypeSmartCrop:
+		// keep the image and crop what is available of the box
+		if !src.Contains(scaled) {
+			scaled = src
+			box = geometry.CropBox(scaled, box)
+		}
+	}
+	return scaled, box, nil
+}
@@ -0,0 +1,44 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseRotation parses an IIIF rotation ("90", "22.5", "!180").
+// A leading "!" requests mirroring before the rotation.
+func ParseRotation(rotation string) (mirror bool, degrees float64, err error) {
+	rotation = strings.TrimSpace(rotation)
+	if strings.HasPrefix(rotation, "!") {
+		mirror = true
+		rotation = rotation[1:]
+	}
+	if rotation == "" {
+		return mirror, 0, nil
+	}
+	degrees, err = strconv.ParseFloat(rotation, 64)
+	if err != nil || math.IsNaN(degrees) || math.IsInf(degrees, 0) {
+		return false, 0, errors.Errorf("invalid rotation '%s'", rotation)
+	}
+	return mirror, normalizeDegrees(degrees), nil
+}
+
+// normalizeDegrees maps degrees to the range [0, 360)
+func normalizeDegrees(degrees float64) float64 {
+	degrees = math.Mod(degrees, 360)
+	if degrees < 0 {
+		degrees += 360
+	}
+	return degrees
+}
+
+// quarterTurns returns the number of clockwise 90 degree turns if degrees is a multiple of 90
+func quarterTurns(degrees float64) (int, bool) {
+	degrees = normalizeDegrees(degrees)
+	if math.Mod(degrees, 90) != 0 {
+		return 0, false
+	}
+	return int(degrees / 90), true
+}
@@ -0,0 +1,33 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseRotation(t *testing.T) {
+	tests := []struct {
+		rotation string
+		mirror   bool
+		degrees  float64
+	}{
+		{"", false, 0},
+		{"90", false, 90},
+		{"!180", true, 180},
+		{"-90", false, 270},
+		{"22.5", false, 22.5},
+		{"!", true, 0},
+	}
+	for _, tt := range tests {
+		mirror, degrees, err := ParseRotation(tt.rotation)
+		if err != nil {
+			t.Errorf("%s: %v", tt.rotation, err)
+			continue
+		}
+		if mirror != tt.mirror || degrees != tt.degrees {
+			t.Errorf("%s: got %v %v, want %v %v", tt.rotation, mirror, degrees, tt.mirror, tt.degrees)
+		}
+	}
+	if _, _, err := ParseRotation("left"); err == nil {
+		t.Error("rotation 'left' succeeded")
+	}
+}
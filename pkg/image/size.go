@@ -0,0 +1,115 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/geometry"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	iiifSizeRegexp = regexp.MustCompile(`^(\d+)?,(\d+)?$`)
+	// legacySizeRegexp matches "<width>x<height>" with 0 as wildcard, which is not part of the iiif grammar
+	legacySizeRegexp = regexp.MustCompile(`^\d+x\d+$`)
+)
+
+// IsLegacySize reports whether size uses the "<width>x<height>" syntax instead of the iiif grammar
+func IsLegacySize(size string) bool {
+	return legacySizeRegexp.MatchString(strings.TrimSpace(size))
+}
+
+// ParseSize computes the target size of an IIIF Image API 3 size ("max", "w,", ",h", "pct:n",
+// "w,h", "!w,h", each with an optional leading "^") for an image of width x height.
+// Sizes larger than the image are only allowed with "^".
+func ParseSize(size string, width, height int) (int, int, error) {
+	orig := size
+	size = strings.TrimSpace(size)
+	if width <= 0 || height <= 0 {
+		return 0, 0, errors.Errorf("invalid image size %dx%d", width, height)
+	}
+	upscale := strings.HasPrefix(size, "^")
+	size = strings.TrimPrefix(size, "^")
+	checkUpscale := func(w, h int) (int, int, error) {
+		if w <= 0 || h <= 0 {
+			return 0, 0, errors.Errorf("size '%s' results in an empty image", orig)
+		}
+		if !upscale && (w > width || h > height) {
+			return 0, 0, errors.Errorf("size '%s' (%dx%d) is larger than the image (%dx%d), use '^' to upscale", orig, w, h, width, height)
+		}
+		return w, h, nil
+	}
+	src := geometry.Size{Width: width, Height: height}
+	fit := func(box geometry.Size) (int, int, error) {
+		fitted, err := geometry.Fit(src, box)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid size '%s'", orig)
+		}
+		return fitted.Width, fitted.Height, nil
+	}
+
+	switch {
+	case size == "max":
+		return width, height, nil
+	case strings.HasPrefix(size, "pct:"):
+		pct, ok := new(big.Rat).SetString(strings.TrimPrefix(size, "pct:"))
+		if !ok || pct.Sign() <= 0 {
+			return 0, 0, errors.Errorf("invalid percentage in size '%s'", orig)
+		}
+		scaled, err := geometry.Scale(src, pct.Quo(pct, big.NewRat(100, 1)))
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid size '%s'", orig)
+		}
+		return checkUpscale(scaled.Width, scaled.Height)
+	}
+
+	best := strings.HasPrefix(size, "!")
+	size = strings.TrimPrefix(size, "!")
+	parts := iiifSizeRegexp.FindStringSubmatch(size)
+	if parts == nil {
+		return 0, 0, errors.Errorf("invalid size '%s'", orig)
+	}
+	// an empty field is the wildcard, any other field has to be a valid number
+	dimension := func(field string) (int, bool, error) {
+		if field == "" {
+			return 0, false, nil
+		}
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "invalid number '%s' in size '%s'", field, orig)
+		}
+		if v == 0 {
+			return 0, false, errors.Errorf("size '%s' results in an empty image", orig)
+		}
+		return v, true, nil
+	}
+	w, hasW, err := dimension(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	h, hasH, err := dimension(parts[2])
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case best:
+		if !hasW || !hasH {
+			return 0, 0, errors.Errorf("size '%s' needs width and height", orig)
+		}
+		if !upscale {
+			w, h = min(w, width), min(h, height)
+		}
+		return fit(geometry.Size{Width: w, Height: h})
+	case hasW && hasH:
+		return checkUpscale(w, h)
+	case hasW || hasH:
+		// the missing dimension is 0 and unbounded
+		w, h, err := fit(geometry.Size{Width: w, Height: h})
+		if err != nil {
+			return 0, 0, err
+		}
+		return checkUpscale(w, h)
+	}
+	return 0, 0, errors.Errorf("invalid size '%s'", orig)
+}
@@ -0,0 +1,43 @@
+package image
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size       string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"max", 400, 300},
+		{"^max", 400, 300},
+		{"200,", 200, 150},
+		{",150", 200, 150},
+		{"pct:50", 200, 150},
+		{"^pct:150", 600, 450},
+		{"100,100", 100, 100},
+		{"!100,100", 100, 75},
+		{"!800,600", 400, 300},
+		{"^!800,600", 800, 600},
+		{"^800,", 800, 600},
+	}
+	for _, tt := range tests {
+		w, h, err := ParseSize(tt.size, 400, 300)
+		if err != nil {
+			t.Errorf("%s: %v", tt.size, err)
+			continue
+		}
+		if w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.size, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+	for _, size := range []string{"", "full", "800,", "pct:150", "!100,", ",", "0,", "pct:0", "100x100", "-1,5", "99999999999999999999,100", "100,99999999999999999999", "!99999999999999999999,100"} {
+		if _, _, err := ParseSize(size, 400, 300); err == nil {
+			t.Errorf("size '%s' succeeded", size)
+		}
+	}
+	if !IsLegacySize("100x0") || IsLegacySize("100,") {
+		t.Error("legacy size not recognized")
+	}
+}
@@ -0,0 +1,104 @@
+package image
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"math"
+)
+
+// smartCropSampleSize is the longest side of the image the crop window is scored on
+const smartCropSampleSize = 256
+
+const (
+	smartCropEdgeWeight       = 1.0
+	smartCropSaturationWeight = 0.5
+	smartCropEntropyWeight    = 0.3
+	// smartCropSteps is the number of candidate positions along the free axis
+	smartCropSteps = 32
+)
+
+// smartCropAnchor scores the candidate windows of the aspect ratio width x height on img and
+// returns the centre of the best one as focal point. The score is the edge density and the
+// saturation of the window and the entropy of its luminance, like smartcrop.js.
+// Ties are resolved towards the centre, so the result is deterministic.
+func smartCropAnchor(img image.Image, width, height int) CropAnchor {
+	anchor := CropAnchor{Focus: true, FocusX: 0.5, FocusY: 0.5}
+	if img.Bounds().Dx() > smartCropSampleSize || img.Bounds().Dy() > smartCropSampleSize {
+		img = resize.Thumbnail(smartCropSampleSize, smartCropSampleSize, img, resize.Bilinear)
+	}
+	rect := img.Bounds()
+	w, h := rect.Dx(), rect.Dy()
+	if w < 3 || h < 3 || width <= 0 || height <= 0 {
+		return anchor
+	}
+	// the largest window with the target aspect ratio
+	winW, winH := w, int(math.Round(float64(w)*float64(height)/float64(width)))
+	if winH > h {
+		winW, winH = int(math.Round(float64(h)*float64(width)/float64(height))), h
+	}
+	winW, winH = max(1, min(winW, w)), max(1, min(winH, h))
+	if winW == w && winH == h {
+		return anchor
+	}
+
+	luma := make([]float64, w*h)
+	saturation := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(rect.Min.X+x, rect.Min.Y+y).RGBA()
+			rf, gf, bf := float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff
+			luma[y*w+x] = 0.2126*rf + 0.7152*gf + 0.0722*bf
+			maxC, minC := math.Max(rf, math.Max(gf, bf)), math.Min(rf, math.Min(gf, bf))
+			if lightness := (maxC + minC) / 2; lightness > 0.05 && lightness < 0.95 {
+				saturation[y*w+x] = (maxC - minC) / (1 - math.Abs(2*lightness-1))
+			}
+		}
+	}
+	// summed area table of the per pixel score, with an extra leading row and column
+	sums := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var edge float64
+			if x > 0 && y > 0 && x < w-1 && y < h-1 {
+				i := y*w + x
+				edge = math.Abs(4*luma[i] - luma[i-1] - luma[i+1] - luma[i-w] - luma[i+w])
+			}
+			score := smartCropEdgeWeight*edge + smartCropSaturationWeight*saturation[y*w+x]
+			sums[(y+1)*(w+1)+x+1] = score + sums[y*(w+1)+x+1] + sums[(y+1)*(w+1)+x] - sums[y*(w+1)+x]
+		}
+	}
+	windowScore := func(left, top int) float64 {
+		right, bottom := left+winW, top+winH
+		sum := sums[bottom*(w+1)+right] - sums[top*(w+1)+right] - sums[bottom*(w+1)+left] + sums[top*(w+1)+left]
+		var histogram [16]int
+		for y := top; y < bottom; y++ {
+			for x := left; x < right; x++ {
+				histogram[min(15, int(luma[y*w+x]*16))]++
+			}
+		}
+		var entropy float64
+		for _, count := range histogram {
+			if count > 0 {
+				p := float64(count) / float64(winW*winH)
+				entropy -= p * math.Log2(p)
+			}
+		}
+		// the entropy of 16 bins is at most 4
+		return sum/float64(winW*winH) + smartCropEntropyWeight*entropy/4
+	}
+
+	// the window spans one axis completely, it moves along the other one
+	freeX, freeY := w-winW, h-winH
+	best, bestDist := math.Inf(-1), math.Inf(1)
+	for step := 0; step <= smartCropSteps; step++ {
+		left, top := freeX*step/smartCropSteps, freeY*step/smartCropSteps
+		score := windowScore(left, top)
+		dist := math.Abs(float64(left)-float64(freeX)/2) + math.Abs(float64(top)-float64(freeY)/2)
+		if score > best+1e-9 || (score > best-1e-9 && dist < bestDist) {
+			best, bestDist = score, dist
+			anchor.FocusX = (float64(left) + float64(winW)/2) / float64(w)
+			anchor.FocusY = (float64(top) + float64(winH)/2) / float64(h)
+		}
+	}
+	return anchor
+}
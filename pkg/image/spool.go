@@ -0,0 +1,33 @@
+package image
+
+import (
+	"emperror.dev/errors"
+	"io"
+	"os"
+)
+
+// spoolFile makes the content of in available as a local file.
+// If in already is a local file, its name is returned. Otherwise, in is
+// copied to a temporary file in tempDir, which is removed by cleanup.
+func spoolFile(in io.Reader, tempDir string) (name string, cleanup func(), err error) {
+	if fp, ok := in.(*os.File); ok {
+		return fp.Name(), func() {}, nil
+	}
+	fp, err := os.CreateTemp(tempDir, "mediaserverimage-*")
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "cannot create temporary file in '%s'", tempDir)
+	}
+	cleanup = func() {
+		_ = os.Remove(fp.Name())
+	}
+	if _, err := io.Copy(fp, in); err != nil {
+		_ = fp.Close()
+		cleanup()
+		return "", nil, errors.Wrapf(err, "cannot write to %s", fp.Name())
+	}
+	if err := fp.Close(); err != nil {
+		cleanup()
+		return "", nil, errors.Wrapf(err, "cannot close %s", fp.Name())
+	}
+	return fp.Name(), cleanup, nil
+}
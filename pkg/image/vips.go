@@ -0,0 +1,714 @@
+//go:build vips && !imagick && cgo
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"emperror.dev/errors"
+	"fmt"
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type vipsImage struct {
+	ref *vips.ImageRef
+	// mappings hold the encoded data the pixels of ref are decoded from
+	mappings []*vipsMapping
+}
+
+func (img *vipsImage) Dimensions() (int, int) {
+	if img.ref == nil {
+		return 0, 0
+	}
+	return img.ref.Width(), img.ref.Height()
+}
+
+func (img *vipsImage) Format() string {
+	if img.ref == nil {
+		return ""
+	}
+	return strings.ToLower(imageTypeNames[img.ref.OriginalFormat()])
+}
+
+func (img *vipsImage) ColorSpace() string {
+	if img.ref == nil {
+		return ""
+	}
+	name, ok := interpretationNames[img.ref.Interpretation()]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+func (img *vipsImage) Pages() int {
+	if img.ref == nil {
+		return 0
+	}
+	return img.ref.Pages()
+}
+
+func (img *vipsImage) Close() error {
+	if img.ref == nil {
+		return nil
+	}
+	img.ref.Close()
+	img.ref = nil
+	var errs []error
+	for _, mapping := range img.mappings {
+		errs = append(errs, mapping.release())
+	}
+	img.mappings = nil
+	return errors.Combine(errs...)
+}
+
+// NewImageHandler starts libvips and creates a handler.
+// Masters are spooled to tempDir and mapped, results are written to tempDir
+// and streamed from there. tempDir also holds the icc profiles.
+func NewImageHandler(tempDir string, logger zLogger.ZLogger) (ImageHandler, error) {
+	_logger := logger.With().Str("class", "vipsImageHandler").Logger()
+	vips.LoggingSettings(func(domain string, level vips.LogLevel, msg string) {
+		switch level {
+		case vips.LogLevelError, vips.LogLevelCritical:
+			_logger.Error().Msgf("%s: %s", domain, msg)
+		case vips.LogLevelWarning:
+			_logger.Warn().Msgf("%s: %s", domain, msg)
+		default:
+			_logger.Debug().Msgf("%s: %s", domain, msg)
+		}
+	}, vips.LogLevelWarning)
+	// the operation cache is disabled, it would keep loaders referencing mappings which are already released.
+	// Concurrency 0 leaves the number of worker threads to libvips.
+	vips.Startup(&vips.Config{
+		ConcurrencyLevel: 0,
+		MaxCacheFiles:    0,
+		MaxCacheMem:      0,
+		MaxCacheSize:     0,
+	})
+	_logger.Debug().Msgf("libvips %s", vips.Version)
+	return &vipsImageHandler{
+		tempDir:      tempDir,
+		profilePaths: map[[sha256.Size]byte]string{},
+		logger:       zLogger.ZLogger(&_logger),
+	}, nil
+}
+
+type vipsImageHandler struct {
+	tempDir      string
+	profileLock  sync.Mutex
+	profilePaths map[[sha256.Size]byte]string
+	logger       zLogger.ZLogger
+}
+
+func (vi *vipsImageHandler) Close() error {
+	vips.Shutdown()
+	vi.profileLock.Lock()
+	defer vi.profileLock.Unlock()
+	for _, path := range vi.profilePaths {
+		if err := os.Remove(path); err != nil {
+			vi.logger.Error().Err(err).Msgf("cannot remove icc profile %s", path)
+		}
+	}
+	clear(vi.profilePaths)
+	return nil
+}
+
+// profilePath returns the name of a file with the content of profile.
+// Every profile is written once and removed on Close.
+func (vi *vipsImageHandler) profilePath(profile []byte) (string, error) {
+	sum := sha256.Sum256(profile)
+	vi.profileLock.Lock()
+	defer vi.profileLock.Unlock()
+	if path, ok := vi.profilePaths[sum]; ok {
+		return path, nil
+	}
+	fp, err := os.CreateTemp(vi.tempDir, "mediaserverimage-*.icc")
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create temporary file in '%s'", vi.tempDir)
+	}
+	if _, err := fp.Write(profile); err != nil {
+		_ = fp.Close()
+		_ = os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "cannot write to %s", fp.Name())
+	}
+	if err := fp.Close(); err != nil {
+		_ = os.Remove(fp.Name())
+		return "", errors.Wrapf(err, "cannot close %s", fp.Name())
+	}
+	vi.profilePaths[sum] = fp.Name()
+	return fp.Name(), nil
+}
+
+// vipsImageType maps the format name of an item to the corresponding libvips loader
+func vipsImageType(format string) (vips.ImageType, bool) {
+	switch strings.ToUpper(format) {
+	case "JPG":
+		format = "JPEG"
+	case "TIF":
+		format = "TIFF"
+	case "JPEG2000", "JPX":
+		format = "JP2"
+	case "HEIC":
+		format = "HEIF"
+	}
+	for imageType, name := range imageTypeNames {
+		if name == strings.ToUpper(format) {
+			return imageType, true
+		}
+	}
+	return vips.ImageTypeUnknown, false
+}
+
+// DecodeRaw is not available, govips has no loader for camera raw formats
+func (vi *vipsImageHandler) DecodeRaw(_ io.Reader, format string, _ WhiteBalance, _ Demosaic, _ RawColorSpace) (Image, error) {
+	return nil, errors.Wrapf(ErrNotSupported, "camera raw format '%s', use the imagick build", format)
+}
+
+func (vi *vipsImageHandler) Decode(in io.Reader, width, height int64, format string, page, density int) (Image, error) {
+	imageType, ok := vipsImageType(format)
+	if !ok || !vips.IsTypeSupported(imageType) {
+		return nil, errors.Wrapf(ErrNotSupported, "format '%s'", format)
+	}
+	if page == AllPages {
+		return nil, errors.Wrap(ErrNotSupported, "animations")
+	}
+	params := vips.NewImportParams()
+	params.Page.Set(page)
+	// only the loaders of vector formats know the dpi option
+	if density > 0 && (imageType == vips.ImageTypePDF || imageType == vips.ImageTypeSVG) {
+		params.Density.Set(density)
+	}
+	// the master is mapped from a file, libvips decodes the pixels lazily from it
+	mapping, err := mapFile(in, vi.tempDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read image data")
+	}
+	img := &vipsImage{mappings: []*vipsMapping{mapping}}
+	img.ref, err = vips.LoadImageFromBuffer(mapping.data, params)
+	if err != nil {
+		_ = mapping.release()
+		return nil, errors.Wrap(err, "cannot read image")
+	}
+	// n-pages counts the pages of the source, not the loaded ones
+	if pages := img.ref.Pages(); page < 0 || page >= max(pages, 1) {
+		_ = img.Close()
+		return nil, errors.Wrapf(ErrPageNotFound, "page %d of %d", page, pages)
+	}
+	vi.logger.Debug().Msgf("format: %s (%dx%d)", imageTypeNames[img.ref.Format()], img.ref.Width(), img.ref.Height())
+	return img, nil
+}
+
+func (vi *vipsImageHandler) Sharpen(img Image, sigma string) error {
+	vImg, err := toVipsImage(img)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	// x1 and m2 are the libvips defaults for flat/jagged threshold and slope
+	if err := vImg.ref.Sharpen(sig, 2.0, 3.0); err != nil {
+		return errors.Wrap(err, "cannot sharpen image")
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) Blur(img Image, sigma string) error {
+	vImg, err := toVipsImage(img)
+	if err != nil {
+		return err
+	}
+	sig, err := parseSigma(sigma)
+	if err != nil {
+		return err
+	}
+	if err := vImg.ref.GaussianBlur(sig); err != nil {
+		return errors.Wrap(err, "cannot blur image")
+	}
+	return nil
+}
+
+// vipsKernels maps the filters to libvips kernels. libvips shrinks by the integer part of the
+// scale with a box filter anyway, box and triangle reduce the rest linearly.
+var vipsKernels = map[Filter]vips.Kernel{
+	FilterLanczos:  vips.KernelLanczos3,
+	FilterMitchell: vips.KernelMitchell,
+	FilterCatrom:   vips.KernelCubic,
+	FilterBox:      vips.KernelLinear,
+	FilterNearest:  vips.KernelNearest,
+	FilterTriangle: vips.KernelLinear,
+}
+
+func (vi *vipsImageHandler) Resize(imgAny Image, size string, resizeType ResizeType, anchor CropAnchor, background color.NRGBA, upscale bool, filter Filter) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	cols, rows := img.ref.Width(), img.ref.Height()
+	scaled, box, err := resizeGeometry(cols, rows, size, resizeType, upscale)
+	if err != nil {
+		return err
+	}
+	if resizeType == ResizeTypeSmartCrop {
+		sample, err := img.sample()
+		if err != nil {
+			return err
+		}
+		anchor = smartCropAnchor(sample, box.Width, box.Height)
+		resizeType = ResizeTypeCrop
+	}
+	hScale := float64(scaled.Width) / float64(cols)
+	vScale := float64(scaled.Height) / float64(rows)
+	if err := img.ref.ResizeWithVScale(hScale, vScale, vipsKernels[filter]); err != nil {
+		return errors.Wrapf(err, "cannot resize image to %dx%d", scaled.Width, scaled.Height)
+	}
+	if resizeType == ResizeTypePad {
+		if background.A < 0xff && !img.ref.HasAlpha() {
+			if err := img.ref.AddAlpha(); err != nil {
+				return errors.Wrap(err, "cannot add alpha channel")
+			}
+		}
+		left, top := anchor.Position(box.Width, box.Height, img.ref.Width(), img.ref.Height())
+		bg := &vips.ColorRGBA{R: background.R, G: background.G, B: background.B, A: background.A}
+		if err := img.ref.EmbedBackgroundRGBA(left, top, box.Width, box.Height, bg); err != nil {
+			return errors.Wrapf(err, "cannot pad image to %dx%d", box.Width, box.Height)
+		}
+	}
+	if resizeType == ResizeTypeCrop {
+		// libvips rounds the scaled size, so never crop outside the image
+		width := min(box.Width, img.ref.Width())
+		height := min(box.Height, img.ref.Height())
+		left, top := anchor.Position(img.ref.Width(), img.ref.Height(), width, height)
+		if err := img.ref.ExtractArea(left, top, width, height); err != nil {
+			return errors.Wrapf(err, "cannot crop image to %dx%d", width, height)
+		}
+	}
+	return nil
+}
+
+var tileRegexp = regexp.MustCompile(`^(\d+)x(\d+)$`)
+
+// parseTile returns the tile geometry or 0, 0 if no tile is given
+func parseTile(tile string) (int, int, error) {
+	if tile == "" {
+		return 0, 0, nil
+	}
+	parts := tileRegexp.FindStringSubmatch(tile)
+	if parts == nil {
+		return 0, 0, errors.Errorf("invalid tile format '%s'", tile)
+	}
+	tileWidth, _ := strconv.Atoi(parts[1])
+	tileHeight, _ := strconv.Atoi(parts[2])
+	return tileWidth, tileHeight, nil
+}
+
+// sample returns a copy of the image scaled to at most smartCropSampleSize pixels
+func (img *vipsImage) sample() (image.Image, error) {
+	ref, err := img.ref.Copy()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot copy image")
+	}
+	defer ref.Close()
+	if err := ref.Thumbnail(smartCropSampleSize, smartCropSampleSize, vips.InterestingNone); err != nil {
+		return nil, errors.Wrap(err, "cannot scale sample")
+	}
+	data, _, err := ref.ExportPng(vips.NewPngExportParams())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot export sample")
+	}
+	sample, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode sample")
+	}
+	return sample, nil
+}
+
+func (vi *vipsImageHandler) Crop(imgAny Image, x, y, width, height int) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := checkCrop(img, x, y, width, height); err != nil {
+		return err
+	}
+	if err := img.ref.ExtractArea(x, y, width, height); err != nil {
+		return errors.Wrapf(err, "cannot crop image to %dx%d+%d+%d", width, height, x, y)
+	}
+	return nil
+}
+
+var vipsAngles = []vips.Angle{vips.Angle0, vips.Angle90, vips.Angle180, vips.Angle270}
+
+func (vi *vipsImageHandler) Rotate(imgAny Image, degrees float64, background color.NRGBA) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if turns, ok := quarterTurns(degrees); ok {
+		if turns == 0 {
+			return nil
+		}
+		if err := img.ref.Rotate(vipsAngles[turns]); err != nil {
+			return errors.Wrapf(err, "cannot rotate image by %d degrees", turns*90)
+		}
+		return nil
+	}
+	// similarity ignores the alpha of the background without an alpha band
+	if background.A < 0xff && !img.ref.HasAlpha() {
+		if err := img.ref.AddAlpha(); err != nil {
+			return errors.Wrap(err, "cannot add alpha channel")
+		}
+	}
+	bg := &vips.ColorRGBA{R: background.R, G: background.G, B: background.B, A: background.A}
+	if err := img.ref.Similarity(1, normalizeDegrees(degrees), bg, 0, 0, 0, 0); err != nil {
+		return errors.Wrapf(err, "cannot rotate image by %v degrees", degrees)
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) Mirror(imgAny Image) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := img.ref.Flip(vips.DirectionHorizontal); err != nil {
+		return errors.Wrap(err, "cannot mirror image")
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) Composite(imgAny, overlayAny Image, x, y int, opacity float64) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	overlay, err := toVipsImage(overlayAny)
+	if err != nil {
+		return err
+	}
+	if err := checkOpacity(opacity); err != nil {
+		return err
+	}
+	if opacity < 1 {
+		if !overlay.ref.HasAlpha() {
+			if err := overlay.ref.AddAlpha(); err != nil {
+				return errors.Wrap(err, "cannot add alpha channel to overlay")
+			}
+		}
+		// scale the alpha band only, it is the last one
+		a := make([]float64, overlay.ref.Bands())
+		b := make([]float64, len(a))
+		for i := range a {
+			a[i] = 1
+		}
+		a[len(a)-1] = opacity
+		if err := overlay.ref.Linear(a, b); err != nil {
+			return errors.Wrapf(err, "cannot set overlay opacity to %v", opacity)
+		}
+	}
+	if err := img.ref.Composite(overlay.ref, vips.BlendModeOver, x, y); err != nil {
+		return errors.Wrapf(err, "cannot composite overlay at %d,%d", x, y)
+	}
+	// the overlay pixels are read when img is written, after overlay may have been closed
+	for _, mapping := range overlay.mappings {
+		img.mappings = append(img.mappings, mapping.acquire())
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) AutoOrient(imgAny Image) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if orientation := img.ref.Orientation(); orientation <= 1 {
+		return nil
+	}
+	// AutoRotate resets the exif orientation to 1
+	if err := img.ref.AutoRotate(); err != nil {
+		return errors.Wrap(err, "cannot auto orient image")
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) TransformColorProfile(imgAny Image, target, fallback []byte) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	targetPath, err := vi.profilePath(target)
+	if err != nil {
+		return err
+	}
+	// "srgb" and "cmyk" are the built-in profiles of libvips
+	fallbackPath := "srgb"
+	if fallback != nil {
+		if fallbackPath, err = vi.profilePath(fallback); err != nil {
+			return err
+		}
+	} else if img.ref.Interpretation() == vips.InterpretationCMYK {
+		fallbackPath = "cmyk"
+	}
+	if err := img.ref.TransformICCProfileWithFallback(targetPath, fallbackPath); err != nil {
+		return errors.Wrap(err, "cannot convert to color profile")
+	}
+	return nil
+}
+
+var vipsColorSpaces = map[ColorSpace]vips.Interpretation{
+	ColorSpaceGray:    vips.InterpretationBW,
+	ColorSpaceBitonal: vips.InterpretationBW,
+	ColorSpaceCMYK:    vips.InterpretationCMYK,
+	ColorSpaceLab:     vips.InterpretationLAB,
+}
+
+func (vi *vipsImageHandler) ConvertColorSpace(imgAny Image, colorSpace ColorSpace, threshold float64, dither bool) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if err := checkThreshold(threshold); err != nil {
+		return err
+	}
+	if colorSpace == ColorSpaceBitonal && dither {
+		return errors.Wrap(ErrNotSupported, "dithering")
+	}
+	if colorSpace == ColorSpaceBitonal && img.ref.HasAlpha() {
+		if err := img.ref.Flatten(&vips.Color{R: 0xff, G: 0xff, B: 0xff}); err != nil {
+			return errors.Wrap(err, "cannot flatten image")
+		}
+	}
+	if err := img.ref.ToColorSpace(vipsColorSpaces[colorSpace]); err != nil {
+		return errors.Wrapf(err, "cannot convert to %s", colorSpace)
+	}
+	if err := vi.StripColorProfile(img); err != nil {
+		return err
+	}
+	if colorSpace != ColorSpaceBitonal {
+		return nil
+	}
+	// a steep ramp around the threshold, the cast to uchar clips it to black and white
+	maxValue := 255.0
+	if img.ref.BandFormat() == vips.BandFormatUshort {
+		maxValue = 65535.0
+	}
+	if err := img.ref.Linear1(1e4, -1e4*threshold*maxValue); err != nil {
+		return errors.Wrapf(err, "cannot threshold image at %v", threshold)
+	}
+	if err := img.ref.Cast(vips.BandFormatUchar); err != nil {
+		return errors.Wrap(err, "cannot cast to uchar")
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) StripColorProfile(imgAny Image) error {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return err
+	}
+	if !img.ref.HasICCProfile() {
+		return nil
+	}
+	if err := img.ref.RemoveICCProfile(); err != nil {
+		return errors.Wrap(err, "cannot remove color profile")
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) Metadata(imgAny Image) (*Metadata, error) {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return nil, err
+	}
+	// reading a missing field is an error in libvips
+	blobs := map[string][]byte{}
+	for _, field := range img.ref.ImageFields() {
+		switch field {
+		case "exif-data", "iptc-data", "xmp-data", "icc-profile-data":
+			blobs[field] = img.ref.GetBlob(field)
+		}
+	}
+	return newMetadata(blobs["exif-data"], blobs["iptc-data"], blobs["xmp-data"], blobs["icc-profile-data"]), nil
+}
+
+// applyMetadataPolicy removes the descriptive fields unless policy is keep.
+// RemoveMetadata keeps the icc profile and the fields needed to write the image.
+func (vi *vipsImageHandler) applyMetadataPolicy(img *vipsImage, policy MetadataPolicy) error {
+	if policy == MetadataKeep {
+		return nil
+	}
+	var r rights
+	if policy == MetadataRightsOnly {
+		metadata, err := vi.Metadata(img)
+		if err != nil {
+			return err
+		}
+		r = metadata.rights()
+	}
+	if err := img.ref.RemoveMetadata(); err != nil {
+		return errors.Wrap(err, "cannot remove metadata")
+	}
+	if exif := r.exif(); exif != nil {
+		img.ref.SetBlob("exif-data", exif)
+	}
+	if xmp := r.xmp(); xmp != nil {
+		img.ref.SetBlob("xmp-data", xmp)
+	}
+	return nil
+}
+
+// vipsDepths are the band formats of depth
+var vipsDepths = map[Depth]vips.BandFormat{
+	Depth8:   vips.BandFormatUchar,
+	Depth16:  vips.BandFormatUshort,
+	Depth32F: vips.BandFormatFloat,
+}
+
+// setDepth converts the samples to uchar, ushort or linear float, gray images stay gray.
+// Images which have the band format of depth already are left as they are.
+func (img *vipsImage) setDepth(depth Depth) error {
+	if depth == DepthSource || img.ref.BandFormat() == vipsDepths[depth] {
+		return nil
+	}
+	gray := img.ref.Bands() < 3
+	var interpretation vips.Interpretation
+	switch {
+	case depth == Depth8 && gray:
+		interpretation = vips.InterpretationBW
+	case depth == Depth8:
+		interpretation = vips.InterpretationSRGB
+	case depth == Depth16 && gray:
+		interpretation = vips.InterpretationGrey16
+	case depth == Depth16:
+		interpretation = vips.InterpretationRGB16
+	default:
+		interpretation = vips.InterpretationScRGB
+	}
+	if err := img.ref.ToColorSpace(interpretation); err != nil {
+		return errors.Wrapf(err, "cannot convert to depth %s", depth)
+	}
+	return nil
+}
+
+func (vi *vipsImageHandler) Encode(imgAny Image, writer io.Writer, format, compress string, quality int, depth Depth, tile string, metadata MetadataPolicy) (uint64, string, error) {
+	img, err := toVipsImage(imgAny)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := vi.applyMetadataPolicy(img, metadata); err != nil {
+		return 0, "", err
+	}
+	if err := checkDepth(format, depth); err != nil {
+		return 0, "", err
+	}
+	if err := img.setDepth(depth); err != nil {
+		return 0, "", err
+	}
+	tileWidth, tileHeight, err := parseTile(tile)
+	if err != nil {
+		return 0, "", err
+	}
+	var mimetype, suffix string
+	var options []string
+	hasQuality := quality >= 0 && quality <= 100
+	if hasQuality {
+		options = append(options, fmt.Sprintf("Q=%d", quality))
+	}
+	switch strings.ToLower(format) {
+	case "jp2", "webp", "avif":
+		// lossless is never implied by the quality
+		switch compress {
+		case "":
+		case "lossless":
+			options = append(options, "lossless")
+		default:
+			return 0, "", errors.Errorf("unsupported compression '%s' for %s", compress, format)
+		}
+		suffix = strings.ToLower(format)
+		mimetype = "image/" + suffix
+		switch suffix {
+		case "jp2":
+			if tileWidth > 0 {
+				options = append(options, fmt.Sprintf("tile_width=%d", tileWidth), fmt.Sprintf("tile_height=%d", tileHeight))
+			}
+		case "avif":
+			options = append(options, "compression=av1")
+		}
+	case "ptif", "tiff", "tif":
+		compression := "none"
+		if compress != "" {
+			var ok bool
+			if compression, ok = compresionNames[compress]; !ok {
+				return 0, "", errors.Errorf("unsupported compression '%s'", compress)
+			}
+		}
+		options = append(options, "compression="+compression)
+		if strings.ToLower(format) == "ptif" {
+			if tileWidth == 0 {
+				tileWidth, tileHeight = 256, 256
+			}
+			if !hasQuality {
+				options = append(options, "Q=75")
+			}
+			options = append(options, "pyramid")
+		}
+		if tileWidth > 0 {
+			options = append(options, "tile", fmt.Sprintf("tile_width=%d", tileWidth), fmt.Sprintf("tile_height=%d", tileHeight))
+		}
+		suffix = "tif"
+		mimetype = "image/tiff"
+	case "jpeg", "jpg":
+		suffix = "jpg"
+		mimetype = "image/jpeg"
+	case "png":
+		// the quality of pngsave would reduce the image to a palette
+		options = nil
+		suffix = "png"
+		mimetype = "image/png"
+	default:
+		return 0, "", errors.Errorf("unsupported format %s", format)
+	}
+	// libvips writes to a file, which is streamed to writer afterwards
+	fp, err := os.CreateTemp(vi.tempDir, "mediaserverimage-*."+suffix)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "cannot create temporary file in '%s'", vi.tempDir)
+	}
+	defer func() {
+		_ = fp.Close()
+		_ = os.Remove(fp.Name())
+	}()
+	if err := vipsSaveFile(img.ref, fmt.Sprintf("%s[%s]", fp.Name(), strings.Join(options, ","))); err != nil {
+		return 0, "", errors.Wrapf(err, "cannot encode image to %s", strings.ToLower(format))
+	}
+	size, err := io.Copy(writer, fp)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "cannot write image data")
+	}
+	return uint64(size), mimetype, nil
+}
+
+// toVipsImage returns the vipsImage behind imgAny or an error if it has already been closed
+func toVipsImage(imgAny Image) (*vipsImage, error) {
+	img, ok := imgAny.(*vipsImage)
+	if !ok {
+		return nil, errors.Errorf("cannot convert %T to *vipsImage", imgAny)
+	}
+	if img.ref == nil {
+		return nil, errors.New("image has already been closed")
+	}
+	return img, nil
+}
+
+var _ ImageHandler = &vipsImageHandler{}
+var _ Image = &vipsImage{}
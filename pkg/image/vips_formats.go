@@ -0,0 +1,50 @@
+//go:build vips && !imagick && cgo
+
+package image
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// compresionNames are the tiff compressions with their libvips names
+var compresionNames = map[string]string{
+	"no":      "none",
+	"jpeg":    "jpeg",
+	"zip":     "deflate",
+	"deflate": "deflate",
+	"rle":     "packbits",
+	"group4":  "ccittfax4",
+	"lzw":     "lzw",
+	"webp":    "webp",
+	"zstd":    "zstd",
+}
+
+var imageTypeNames = map[vips.ImageType]string{
+	vips.ImageTypeGIF:    "GIF",
+	vips.ImageTypeJPEG:   "JPEG",
+	vips.ImageTypeMagick: "MAGICK",
+	vips.ImageTypePDF:    "PDF",
+	vips.ImageTypePNG:    "PNG",
+	vips.ImageTypeSVG:    "SVG",
+	vips.ImageTypeTIFF:   "TIFF",
+	vips.ImageTypeWEBP:   "WEBP",
+	vips.ImageTypeHEIF:   "HEIF",
+	vips.ImageTypeBMP:    "BMP",
+	vips.ImageTypeAVIF:   "AVIF",
+	vips.ImageTypeJP2K:   "JP2",
+	vips.ImageTypeJXL:    "JXL",
+}
+
+var interpretationNames = map[vips.Interpretation]string{
+	vips.InterpretationSRGB:   "srgb",
+	vips.InterpretationRGB:    "rgb",
+	vips.InterpretationRGB16:  "srgb",
+	vips.InterpretationScRGB:  "scrgb",
+	vips.InterpretationBW:     "gray",
+	vips.InterpretationGrey16: "gray",
+	vips.InterpretationCMYK:   "cmyk",
+	vips.InterpretationLAB:    "lab",
+	vips.InterpretationLABS:   "lab",
+	vips.InterpretationXYZ:    "xyz",
+	vips.InterpretationHSV:    "hsv",
+}
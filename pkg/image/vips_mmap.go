@@ -0,0 +1,66 @@
+//go:build vips && !imagick && cgo
+
+package image
+
+import (
+	"emperror.dev/errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// vipsMapping is a master spooled to a file and mapped read only.
+// libvips decodes lazily from the mapping, its pages are backed by the file instead of the heap.
+// Every image whose pixels may still be read from it holds a reference.
+type vipsMapping struct {
+	data []byte
+	refs atomic.Int32
+}
+
+// mapFile maps the content of in, which is spooled to tempDir first unless it is a local file
+func mapFile(in io.Reader, tempDir string) (*vipsMapping, error) {
+	name, cleanup, err := spoolFile(in, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping stays valid after the spooled file is removed
+	defer cleanup()
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open %s", name)
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot stat %s", name)
+	}
+	if fi.Size() == 0 {
+		return nil, errors.Errorf("no image data in %s", name)
+	}
+	data, err := syscall.Mmap(int(fp.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot map %s", name)
+	}
+	m := &vipsMapping{data: data}
+	m.refs.Store(1)
+	return m, nil
+}
+
+// acquire adds a reference to the mapping
+func (m *vipsMapping) acquire() *vipsMapping {
+	m.refs.Add(1)
+	return m
+}
+
+// release removes a reference, the last one unmaps the data
+func (m *vipsMapping) release() error {
+	if m.refs.Add(-1) > 0 {
+		return nil
+	}
+	if err := syscall.Munmap(m.data); err != nil {
+		return errors.Wrap(err, "cannot unmap image data")
+	}
+	m.data = nil
+	return nil
+}
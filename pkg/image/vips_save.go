@@ -0,0 +1,47 @@
+//go:build vips && !imagick && cgo
+
+package image
+
+// #cgo pkg-config: vips
+// #include <stdlib.h>
+// #include <vips/vips.h>
+//
+// static int mediaserver_save(VipsImage *in, const char *filename) {
+//     return vips_image_write_to_file(in, filename, NULL);
+// }
+import "C"
+
+import (
+	"emperror.dev/errors"
+	"github.com/davidbyttow/govips/v2/vips"
+	"reflect"
+	"unsafe"
+)
+
+// vipsHandle returns the VipsImage behind ref.
+// govips keeps it unexported and exports to memory buffers only, so the
+// savers are called on the handle directly.
+func vipsHandle(ref *vips.ImageRef) (*C.VipsImage, error) {
+	field := reflect.ValueOf(ref).Elem().FieldByName("image")
+	if !field.IsValid() || field.Kind() != reflect.Pointer || field.IsNil() {
+		return nil, errors.New("cannot get libvips image of govips image")
+	}
+	return (*C.VipsImage)(field.UnsafePointer()), nil
+}
+
+// vipsSaveFile writes the image to filename. The saver is selected by the suffix,
+// options follow in brackets as libvips option string (e.g. "out.tif[compression=lzw,tile]").
+func vipsSaveFile(ref *vips.ImageRef, filename string) error {
+	handle, err := vipsHandle(ref)
+	if err != nil {
+		return err
+	}
+	cFilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cFilename))
+	if res := C.mediaserver_save(handle, cFilename); res != 0 {
+		msg := C.GoString(C.vips_error_buffer())
+		C.vips_error_clear()
+		return errors.Errorf("cannot save %s: %s", filename, msg)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+//go:build vips && !imagick && cgo
+
+package image
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVipsLossless(t *testing.T) {
+	// lossy webp has a VP8 chunk, lossless webp a VP8L chunk
+	tests := []struct {
+		compress string
+		chunk    string
+	}{
+		{compress: "", chunk: "VP8 "},
+		{compress: "lossless", chunk: "VP8L"},
+	}
+	for _, test := range tests {
+		img := decodeFixture(t, testHandler, 64, 48)
+		out := &bytes.Buffer{}
+		if _, _, err := testHandler.Encode(img, out, "webp", test.compress, 100, DepthSource, "", MetadataKeep); err != nil {
+			t.Fatalf("cannot encode webp with compression '%s': %v", test.compress, err)
+		}
+		if chunk := string(out.Bytes()[12:16]); chunk != test.chunk {
+			t.Errorf("compression '%s' at quality 100 wrote chunk %s, want %s", test.compress, chunk, test.chunk)
+		}
+	}
+	img := decodeFixture(t, testHandler, 64, 48)
+	if _, _, err := testHandler.Encode(img, &bytes.Buffer{}, "webp", "lzw", 80, DepthSource, "", MetadataKeep); err == nil {
+		t.Error("webp with compression lzw accepted")
+	}
+}
+
+func TestVipsTiledTiff(t *testing.T) {
+	tests := []struct {
+		format    string
+		tile      string
+		tileWidth uint32
+	}{
+		{format: "tiff", tile: ""},
+		{format: "tiff", tile: "64x32", tileWidth: 64},
+		{format: "ptif", tile: "", tileWidth: 256},
+		{format: "ptif", tile: "128x128", tileWidth: 128},
+	}
+	for _, test := range tests {
+		img := decodeFixture(t, testHandler, 300, 200)
+		out := &bytes.Buffer{}
+		if _, _, err := testHandler.Encode(img, out, test.format, "", 80, DepthSource, test.tile, MetadataKeep); err != nil {
+			t.Fatalf("cannot encode %s with tile '%s': %v", test.format, test.tile, err)
+		}
+		// 322 is TileWidth
+		tileWidth, tiled := tiffTag(t, out.Bytes(), 322)
+		if tiled != (test.tileWidth > 0) || tileWidth != test.tileWidth {
+			t.Errorf("%s with tile '%s' has tile width %d, want %d", test.format, test.tile, tileWidth, test.tileWidth)
+		}
+	}
+}
+
+func TestVipsDecodeFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "fixture.png")
+	if err := os.WriteFile(name, fixture(t, 40, 30), 0o644); err != nil {
+		t.Fatalf("cannot write fixture: %v", err)
+	}
+	fp, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("cannot open fixture: %v", err)
+	}
+	defer fp.Close()
+	img, err := testHandler.Decode(fp, 40, 30, "png", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode file: %v", err)
+	}
+	defer img.Close()
+	if width, height := img.Dimensions(); width != 40 || height != 30 {
+		t.Errorf("got %dx%d, want 40x30", width, height)
+	}
+	if _, _, err := testHandler.Encode(img, &bytes.Buffer{}, "png", "", 0, DepthSource, "", MetadataKeep); err != nil {
+		t.Errorf("cannot encode: %v", err)
+	}
+}
+
+func TestVipsCompositeClosedOverlay(t *testing.T) {
+	// the overlay is read lazily when img is encoded, its data must outlive its Close
+	img := decodeFixture(t, testHandler, 80, 60)
+	overlay, err := testHandler.Decode(bytes.NewReader(fixture(t, 20, 20)), 20, 20, "png", 0, 0)
+	if err != nil {
+		t.Fatalf("cannot decode overlay: %v", err)
+	}
+	if err := testHandler.Composite(img, overlay, 10, 10, 0.5); err != nil {
+		t.Fatalf("cannot composite: %v", err)
+	}
+	if err := overlay.Close(); err != nil {
+		t.Fatalf("cannot close overlay: %v", err)
+	}
+	if _, _, err := testHandler.Encode(img, &bytes.Buffer{}, "png", "", 0, DepthSource, "", MetadataKeep); err != nil {
+		t.Errorf("cannot encode after closing overlay: %v", err)
+	}
+}
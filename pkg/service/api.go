@@ -2,6 +2,8 @@ package service
 
 import (
 	"context"
+	"emperror.dev/errors"
+	"encoding/json"
 	"fmt"
 	"github.com/je4/filesystem/v3/pkg/writefs"
 	"github.com/je4/utils/v2/pkg/zLogger"
@@ -19,8 +21,10 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"image/color"
 	"io/fs"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,11 +32,47 @@ import (
 
 var Type = "image"
 var Params = map[string][]string{
-	"resize":  {"size", "format", "stretch", "crop", "aspect", "sharpen", "blur", "tile", "compress", "quality"},
-	"convert": {"format", "tile", "compress", "quality"},
+	"resize":     {"size", "page", "frame", "density", "dpi", "format", "stretch", "crop", "smartcrop", "pad", "aspect", "gravity", "focus", "sharpen", "blur", "rotate", "mirror", "background", "tile", "compress", "quality", "depth", "noautoorient", "colorprofile", "stripprofile", "colorspace", "threshold", "dither", "metadata", "upscale", "filter", "watermark", "watermarkgravity", "watermarkposition", "watermarkmargin", "watermarkopacity", "watermarkscale"},
+	"convert":    {"page", "frame", "density", "dpi", "format", "rotate", "mirror", "background", "tile", "compress", "quality", "depth", "noautoorient", "colorprofile", "stripprofile", "colorspace", "threshold", "dither", "metadata", "upscale", "filter", "watermark", "watermarkgravity", "watermarkposition", "watermarkmargin", "watermarkopacity", "watermarkscale"},
+	"metadata":   {"page", "frame"},
+	"rawdevelop": {"whitebalance", "demosaic", "rawcolor", "format", "compress", "quality", "depth", "metadata", "watermark", "watermarkgravity", "watermarkposition", "watermarkmargin", "watermarkopacity", "watermarkscale"},
+	"region":     {"region", "size", "page", "frame", "density", "dpi", "format", "stretch", "crop", "smartcrop", "pad", "aspect", "gravity", "focus", "sharpen", "blur", "rotate", "mirror", "background", "tile", "compress", "quality", "depth", "noautoorient", "colorprofile", "stripprofile", "colorspace", "threshold", "dither", "metadata", "upscale", "filter", "watermark", "watermarkgravity", "watermarkposition", "watermarkmargin", "watermarkopacity", "watermarkscale"},
 }
 
-func NewActionService(adClients map[string]mediaserverproto.ActionDispatcherClient, instance string, domains []string, concurrency, queueSize uint32, refreshErrorTimeout time.Duration, vfs fs.FS, dbs map[string]mediaserverproto.DatabaseClient, logger zLogger.ZLogger) (*imageAction, error) {
+// DomainConfig holds the defaults of a domain, empty values use the defaults of the service
+type DomainConfig struct {
+	Metadata string `toml:"metadata"`
+	// Watermark names the watermark composited onto every derivative of the domain
+	Watermark string `toml:"watermark"`
+	// Upscale allows enlarging images beyond their size without the upscale parameter
+	Upscale bool `toml:"upscale"`
+}
+
+func NewActionService(adClients map[string]mediaserverproto.ActionDispatcherClient, instance string, domains []string, concurrency, queueSize uint32, refreshErrorTimeout time.Duration, vfs fs.FS, dbs map[string]mediaserverproto.DatabaseClient, colorProfiles map[string][]byte, domainConfigs map[string]DomainConfig, watermarkConfigs map[string]WatermarkConfig, tempDir string, logger zLogger.ZLogger) (*imageAction, error) {
+	if _, ok := colorProfiles[defaultColorProfile]; !ok {
+		return nil, errors.Errorf("color profile %s not found", defaultColorProfile)
+	}
+	for domain, domainConfig := range domainConfigs {
+		if domainConfig.Metadata == "" {
+			continue
+		}
+		if _, err := image.ParseMetadataPolicy(domainConfig.Metadata); err != nil {
+			return nil, errors.Wrapf(err, "invalid metadata default of domain %s", domain)
+		}
+	}
+	for domain, domainConfig := range domainConfigs {
+		if _, ok := watermarkConfigs[domainConfig.Watermark]; domainConfig.Watermark != "" && !ok {
+			return nil, errors.Errorf("unknown watermark %s of domain %s", domainConfig.Watermark, domain)
+		}
+	}
+	watermarks, err := loadWatermarks(vfs, watermarkConfigs)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load watermarks")
+	}
+	imageHandler, err := image.NewImageHandler(tempDir, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create image handler")
+	}
 	_logger := logger.With().Str("rpcService", "imageAction").Logger()
 	return &imageAction{
 		actionDispatcherClients: adClients,
@@ -42,8 +82,11 @@ func NewActionService(adClients map[string]mediaserverproto.ActionDispatcherClie
 		refreshErrorTimeout:     refreshErrorTimeout,
 		vFS:                     vfs,
 		dbs:                     dbs,
+		colorProfiles:           colorProfiles,
+		domainConfigs:           domainConfigs,
+		watermarks:              watermarks,
 		logger:                  &_logger,
-		image:                   image.NewImageHandler(logger),
+		image:                   imageHandler,
 		concurrency:             concurrency,
 		queueSize:               queueSize,
 	}, nil
@@ -58,6 +101,9 @@ type imageAction struct {
 	vFS                     fs.FS
 	dbs                     map[string]mediaserverproto.DatabaseClient
 	image                   image.ImageHandler
+	colorProfiles           map[string][]byte
+	domainConfigs           map[string]DomainConfig
+	watermarks              map[string]*watermark
 	concurrency             uint32
 	queueSize               uint32
 	instance                string
@@ -151,20 +197,200 @@ func (ia *imageAction) GetParams(ctx context.Context, param *mediaserverproto.Pa
 
 var isUrlRegexp = regexp.MustCompile(`^[a-z]+://`)
 
-func (ia *imageAction) loadImage(imagePath string, width, height int64, imgType string) (any, error) {
-	fp, err := ia.vFS.Open(imagePath)
+// animationFormats can hold animations as source and derivative
+var animationFormats = []string{"gif", "webp"}
+
+// pageIndex returns the index of the page or frame parameter, which count from 1.
+// Without them animations are kept if the derivative format supports them.
+func pageIndex(imgType string, params actionParams.ActionParams) (int, error) {
+	str := params.Get("page")
+	if str == "" {
+		str = params.Get("frame")
+	}
+	if str == "" {
+		if slices.Contains(animationFormats, strings.ToLower(imgType)) && slices.Contains(animationFormats, strings.ToLower(params.Get("format"))) {
+			return image.AllPages, nil
+		}
+		return 0, nil
+	}
+	page, err := strconv.Atoi(str)
+	if err != nil || page < 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid page %s", str)
+	}
+	return page - 1, nil
+}
+
+// maxDensity limits the resolution of rasterised vector formats
+const maxDensity = 1200
+
+// density returns the resolution in dpi of the density parameter or its alias dpi, 0 if not set
+func density(params actionParams.ActionParams) (int, error) {
+	str := params.Get("density")
+	if str == "" {
+		str = params.Get("dpi")
+	}
+	if str == "" {
+		return 0, nil
+	}
+	dpi, err := strconv.Atoi(str)
+	if err != nil || dpi < 1 || dpi > maxDensity {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid density %s, allowed are 1 to %d", str, maxDensity)
+	}
+	return dpi, nil
+}
+
+// rawOptions returns the whitebalance, demosaic and rawcolor parameters of a raw development
+func rawOptions(params actionParams.ActionParams) (image.WhiteBalance, image.Demosaic, image.RawColorSpace, error) {
+	whiteBalance, err := image.ParseWhiteBalance(params.Get("whitebalance"))
+	if err != nil {
+		return 0, 0, 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	demosaic, err := image.ParseDemosaic(params.Get("demosaic"))
+	if err != nil {
+		return 0, 0, 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	colorSpace, err := image.ParseRawColorSpace(params.Get("rawcolor"))
+	if err != nil {
+		return 0, 0, 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return whiteBalance, demosaic, colorSpace, nil
+}
+
+// decodeImage decodes the selected page of the master as it is, camera raw masters are developed
+func (ia *imageAction) decodeImage(imagePath string, width, height int64, imgType string, params actionParams.ActionParams) (image.Image, error) {
+	page, err := pageIndex(imgType, params)
+	if err != nil {
+		return nil, err
+	}
+	dpi, err := density(params)
+	if err != nil {
+		return nil, err
+	}
+	whiteBalance, demosaic, rawColorSpace, err := rawOptions(params)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "cannot open %s: %v", imagePath, err)
+		return nil, err
+	}
+	decode := func(page int) (image.Image, error) {
+		fp, err := ia.vFS.Open(imagePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "cannot open %s: %v", imagePath, err)
+		}
+		defer fp.Close()
+		if image.IsRawFormat(imgType) {
+			return ia.image.DecodeRaw(fp, imgType, whiteBalance, demosaic, rawColorSpace)
+		}
+		return ia.image.Decode(fp, width, height, imgType, page, dpi)
+	}
+	img, err := decode(page)
+	if page == image.AllPages && errors.Is(err, image.ErrNotSupported) {
+		ia.logger.Debug().Msgf("cannot keep animation of %s: %v", imagePath, err)
+		img, err = decode(0)
 	}
-	defer fp.Close()
-	img, err := ia.image.Decode(fp, width, height, imgType)
 	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, err
+		}
+		if errors.Is(err, image.ErrPageNotFound) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot decode %s: %v", imagePath, err)
+		}
+		if errors.Is(err, image.ErrNotSupported) {
+			return nil, status.Errorf(codes.Unimplemented, "cannot decode %s: %v", imagePath, err)
+		}
 		return nil, status.Errorf(codes.Internal, "cannot decode %s: %v", imagePath, err)
 	}
+	w, h := img.Dimensions()
+	ia.logger.Debug().Msgf("loaded %s: %s %dx%d %s, %d page(s)", imagePath, img.Format(), w, h, img.ColorSpace(), img.Pages())
 	return img, nil
 }
 
-func (ia *imageAction) storeImage(img any, action string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams, format, compress string, quality int, tile string) (*mediaserverproto.Cache, error) {
+// loadImage decodes the master, applies the exif orientation and converts it to the target color profile
+func (ia *imageAction) loadImage(imagePath string, width, height int64, imgType string, params actionParams.ActionParams) (image.Image, error) {
+	img, err := ia.decodeImage(imagePath, width, height, imgType, params)
+	if err != nil {
+		return nil, err
+	}
+	if !params.Has("noautoorient") {
+		if err := ia.image.AutoOrient(img); err != nil {
+			_ = img.Close()
+			return nil, status.Errorf(codes.Internal, "cannot auto orient %s: %v", imagePath, err)
+		}
+	}
+	if err := ia.colorManage(img, params); err != nil {
+		_ = img.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+const defaultColorProfile = "srgb"
+
+// colorManage converts img to the profile named by the colorprofile parameter.
+// The default is srgb, gray images stay gray. "none" keeps pixels and embedded profile as they are.
+func (ia *imageAction) colorManage(img image.Image, params actionParams.ActionParams) error {
+	profileName := strings.ToLower(params.Get("colorprofile"))
+	if profileName == "" {
+		profileName = defaultColorProfile
+		if _, ok := ia.colorProfiles["gray"]; ok && img.ColorSpace() == "gray" {
+			profileName = "gray"
+		}
+	}
+	if profileName != "none" {
+		target, ok := ia.colorProfiles[profileName]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown color profile %s", profileName)
+		}
+		// images without embedded profile are interpreted with the profile of their color space
+		fallback := ia.colorProfiles[img.ColorSpace()]
+		if err := ia.image.TransformColorProfile(img, target, fallback); err != nil {
+			if !errors.Is(err, image.ErrNotSupported) {
+				return status.Errorf(codes.Internal, "cannot convert to color profile %s: %v", profileName, err)
+			}
+			if params.Has("colorprofile") {
+				return status.Errorf(codes.Unimplemented, "cannot convert to color profile %s: %v", profileName, err)
+			}
+			ia.logger.Debug().Msgf("no color management: %v", err)
+		}
+	}
+	if params.Has("stripprofile") {
+		if err := ia.image.StripColorProfile(img); err != nil {
+			return status.Errorf(codes.Internal, "cannot strip color profile: %v", err)
+		}
+	}
+	return nil
+}
+
+// convertColorSpace applies the colorspace parameter with threshold (0.5 by default) and dither for bitonal.
+// The configured profile of the same name is embedded unless stripprofile is set.
+func (ia *imageAction) convertColorSpace(img image.Image, params actionParams.ActionParams) error {
+	if params.Get("colorspace") == "" {
+		return nil
+	}
+	colorSpace, err := image.ParseColorSpace(params.Get("colorspace"))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	threshold := 0.5
+	if str := params.Get("threshold"); str != "" {
+		if threshold, err = strconv.ParseFloat(str, 64); err != nil || threshold < 0 || threshold > 1 {
+			return status.Errorf(codes.InvalidArgument, "invalid threshold %s, allowed are 0 to 1", str)
+		}
+	}
+	if err := ia.image.ConvertColorSpace(img, colorSpace, threshold, params.Has("dither")); err != nil {
+		if errors.Is(err, image.ErrNotSupported) {
+			return status.Errorf(codes.Unimplemented, "cannot convert to %s: %v", colorSpace, err)
+		}
+		return status.Errorf(codes.Internal, "cannot convert to %s: %v", colorSpace, err)
+	}
+	// the pixels are converted already, the transformation only embeds the profile
+	if profile, ok := ia.colorProfiles[colorSpace.String()]; ok && !params.Has("stripprofile") {
+		if err := ia.image.TransformColorProfile(img, profile, profile); err != nil && !errors.Is(err, image.ErrNotSupported) {
+			return status.Errorf(codes.Internal, "cannot embed color profile %s: %v", colorSpace, err)
+		}
+	}
+	return nil
+}
+
+func (ia *imageAction) storeImage(img image.Image, action string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams, format, compress string, quality int, depth image.Depth, tile string, metadataPolicy image.MetadataPolicy) (*mediaserverproto.Cache, error) {
 	itemIdentifier := item.GetIdentifier()
 	cacheName := actionController.CreateCacheName(itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), action, params.String(), format)
 	targetPath := fmt.Sprintf(
@@ -183,11 +409,11 @@ func (ia *imageAction) storeImage(img any, action string, item *mediaserverproto
 			ia.logger.Info().Msgf("stored %s/%s", ia.vFS, targetPath)
 		}
 	}()
-	filesize, mime, err := ia.image.Encode(img, target, format, compress, quality, tile)
+	filesize, mime, err := ia.image.Encode(img, target, format, compress, quality, depth, tile, metadataPolicy)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "cannot encode %s: %v", targetPath, err)
 	}
-	width, height := ia.image.GetDimension(img)
+	width, height := img.Dimensions()
 	resp := &mediaserverproto.Cache{
 		Identifier: &mediaserverproto.ItemIdentifier{
 			Collection: itemIdentifier.GetCollection(),
@@ -209,50 +435,207 @@ func (ia *imageAction) storeImage(img any, action string, item *mediaserverproto
 
 }
 
-func (ia *imageAction) resize(item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
-	var err error
-	itemIdentifier := item.GetIdentifier()
-
-	cacheItemMetadata := itemCache.GetMetadata()
-	size := params.Get("size")
-	if size == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "no size defined")
-	}
-	format := params.Get("format")
+// encodeParams returns format, compression, quality, sample depth and tiling of the derivative
+func encodeParams(params actionParams.ActionParams) (format, compress string, quality int, depth image.Depth, tile string, err error) {
+	format = params.Get("format")
 	if format == "" {
 		format = "jpeg"
 	}
 	qualityStr := params.Get("quality")
-	quality := 100
+	quality = 100
 	if qualityStr != "" {
 		quality, err = strconv.Atoi(qualityStr)
 		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid quality %s", qualityStr)
+			return "", "", 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid quality %s", qualityStr)
 		}
 		if quality < 0 || quality > 100 {
-			return nil, status.Errorf(codes.InvalidArgument, "quality %d not >= 0 and <= 100", quality)
+			return "", "", 0, 0, "", status.Errorf(codes.InvalidArgument, "quality %d not >= 0 and <= 100", quality)
+		}
+	}
+	depth, err = image.ParseDepth(params.Get("depth"))
+	if err != nil {
+		return "", "", 0, 0, "", status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return format, params.Get("compress"), quality, depth, params.Get("tile"), nil
+}
+
+// defaultMetadataPolicy keeps creator and rights statement but drops gps coordinates and camera details
+const defaultMetadataPolicy = image.MetadataRightsOnly
+
+// metadataPolicy returns the metadata parameter, the default of the domain or the default of the service
+func (ia *imageAction) metadataPolicy(domain string, params actionParams.ActionParams) (image.MetadataPolicy, error) {
+	name := params.Get("metadata")
+	if name == "" {
+		name = ia.domainConfigs[domain].Metadata
+	}
+	if name == "" {
+		return defaultMetadataPolicy, nil
+	}
+	policy, err := image.ParseMetadataPolicy(name)
+	if err != nil {
+		return 0, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return policy, nil
+}
+
+// upscale returns the upscale parameter ("true" if empty) or the default of the domain
+func (ia *imageAction) upscale(domain string, params actionParams.ActionParams) (bool, error) {
+	if !params.Has("upscale") {
+		return ia.domainConfigs[domain].Upscale, nil
+	}
+	str := params.Get("upscale")
+	if str == "" {
+		return true, nil
+	}
+	upscale, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid upscale %s", str)
+	}
+	return upscale, nil
+}
+
+// resolveSize translates an iiif size into "<width>x<height>" for the current size of img.
+// The computed size is exact unless crop, smartcrop or pad is requested, "" means no resize.
+// upscale allows iiif sizes beyond the image without "^", a "^" enables upscale.
+func resolveSize(img image.Image, size string, resizeType image.ResizeType, upscale bool) (string, image.ResizeType, bool, error) {
+	if image.IsLegacySize(size) {
+		return size, resizeType, upscale, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(size), "^") {
+		upscale = true
+	} else if upscale {
+		size = "^" + strings.TrimSpace(size)
+	}
+	width, height := img.Dimensions()
+	w, h, err := image.ParseSize(size, width, height)
+	if err != nil {
+		return "", resizeType, upscale, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	if resizeType == image.ResizeTypeAspect {
+		resizeType = image.ResizeTypeStretch
+	}
+	if w == width && h == height && resizeType == image.ResizeTypeStretch {
+		return "", resizeType, upscale, nil
+	}
+	return fmt.Sprintf("%dx%d", w, h), resizeType, upscale, nil
+}
+
+// cropAnchor returns the area kept by a crop resize, a focal point takes precedence over gravity
+func cropAnchor(params actionParams.ActionParams) (image.CropAnchor, error) {
+	var anchor image.CropAnchor
+	var err error
+	if focus := params.Get("focus"); focus != "" {
+		anchor.FocusX, anchor.FocusY, err = image.ParseFocus(focus)
+		if err != nil {
+			return anchor, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		anchor.Focus = true
+	}
+	if anchor.Gravity, err = image.ParseGravity(params.Get("gravity")); err != nil {
+		return anchor, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return anchor, nil
+}
+
+// backgroundColor returns the background parameter, white by default
+func backgroundColor(params actionParams.ActionParams) (color.NRGBA, error) {
+	bgStr := params.Get("background")
+	if bgStr == "" {
+		return color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, nil
+	}
+	background, err := image.ParseColor(bgStr)
+	if err != nil {
+		return color.NRGBA{}, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return background, nil
+}
+
+// rotate applies the mirror and rotate parameters, the image is mirrored first
+func (ia *imageAction) rotate(img image.Image, params actionParams.ActionParams) error {
+	mirror, degrees, err := image.ParseRotation(params.Get("rotate"))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	background, err := backgroundColor(params)
+	if err != nil {
+		return err
+	}
+	if mirror || params.Has("mirror") {
+		if err := ia.image.Mirror(img); err != nil {
+			return status.Errorf(codes.Internal, "cannot mirror image: %v", err)
 		}
 	}
-	compress := params.Get("compress")
-	tile := params.Get("tile")
+	if degrees != 0 {
+		if err := ia.image.Rotate(img, degrees, background); err != nil {
+			return status.Errorf(codes.Internal, "cannot rotate image: %v", err)
+		}
+	}
+	return nil
+}
+
+func (ia *imageAction) resize(domain string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
+	itemIdentifier := item.GetIdentifier()
+
+	cacheItemMetadata := itemCache.GetMetadata()
+	size := params.Get("size")
+	if size == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "no size defined")
+	}
+	format, compress, quality, depth, tile, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	metadataPolicy, err := ia.metadataPolicy(domain, params)
+	if err != nil {
+		return nil, err
+	}
 	var resizeType = image.ResizeTypeAspect
 	if params.Has("stretch") {
 		resizeType = image.ResizeTypeStretch
 	} else if params.Has("crop") {
 		resizeType = image.ResizeTypeCrop
+	} else if params.Has("smartcrop") {
+		resizeType = image.ResizeTypeSmartCrop
+	} else if params.Has("pad") {
+		resizeType = image.ResizeTypePad
+	}
+	anchor, err := cropAnchor(params)
+	if err != nil {
+		return nil, err
+	}
+	background, err := backgroundColor(params)
+	if err != nil {
+		return nil, err
+	}
+	upscale, err := ia.upscale(domain, params)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := image.ParseFilter(params.Get("filter"))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
 	}
 	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "resize", params.String())
 	itemImagePath := cacheItemMetadata.GetPath()
 	if !isUrlRegexp.MatchString(itemImagePath) {
 		itemImagePath = fmt.Sprintf("%s/%s", storage.GetFilebase(), strings.TrimPrefix(itemImagePath, "/"))
 	}
-	img, err := ia.loadImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype())
+	img, err := ia.loadImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype(), params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	size, resizeType, upscale, err = resolveSize(img, size, resizeType, upscale)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot decode %s: %v", itemImagePath, err)
+		return nil, err
+	}
+	if size != "" {
+		if err := ia.image.Resize(img, size, resizeType, anchor, background, upscale, filter); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot resize %s: %v", itemImagePath, err)
+		}
 	}
-	defer ia.image.Release(img)
-	if err := ia.image.Resize(img, size, resizeType); err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot resize %s: %v", itemImagePath, err)
+	if err := ia.rotate(img, params); err != nil {
+		return nil, err
 	}
 
 	if params.Has("blur") {
@@ -267,41 +650,275 @@ func (ia *imageAction) resize(item *mediaserverproto.Item, itemCache *mediaserve
 		}
 	}
 
-	return ia.storeImage(img, "resize", item, itemCache, storage, params, format, compress, quality, tile)
+	if err := ia.watermark(domain, img, params); err != nil {
+		return nil, err
+	}
+	if err := ia.convertColorSpace(img, params); err != nil {
+		return nil, err
+	}
+	return ia.storeImage(img, "resize", item, itemCache, storage, params, format, compress, quality, depth, tile, metadataPolicy)
 }
 
-func (ia *imageAction) convert(item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
-	var err error
+func (ia *imageAction) convert(domain string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
 	itemIdentifier := item.GetIdentifier()
 	cacheItemMetadata := itemCache.GetMetadata()
-	format := params.Get("format")
-	if format == "" {
-		format = "jpeg"
+	format, compress, quality, depth, tile, err := encodeParams(params)
+	if err != nil {
+		return nil, err
 	}
-	qualityStr := params.Get("quality")
-	quality := 100
-	if qualityStr != "" {
-		quality, err = strconv.Atoi(qualityStr)
+	metadataPolicy, err := ia.metadataPolicy(domain, params)
+	if err != nil {
+		return nil, err
+	}
+	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "convert", params.String())
+	itemImagePath := cacheItemMetadata.GetPath()
+	if !isUrlRegexp.MatchString(itemImagePath) {
+		itemImagePath = fmt.Sprintf("%s/%s", storage.GetFilebase(), strings.TrimPrefix(itemImagePath, "/"))
+	}
+	img, err := ia.loadImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype(), params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	if err := ia.rotate(img, params); err != nil {
+		return nil, err
+	}
+	if err := ia.watermark(domain, img, params); err != nil {
+		return nil, err
+	}
+	if err := ia.convertColorSpace(img, params); err != nil {
+		return nil, err
+	}
+	return ia.storeImage(img, "convert", item, itemCache, storage, params, format, compress, quality, depth, tile, metadataPolicy)
+}
+
+// rawFormats are the derivatives of rawdevelop, tiff keeps 16 bit per channel
+var rawFormats = []string{"tiff", "tif", "jpeg", "jpg"}
+
+// rawdevelop writes the developed camera raw master without further processing.
+// The profile of the raw colour space is embedded if it is configured.
+func (ia *imageAction) rawdevelop(domain string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
+	itemIdentifier := item.GetIdentifier()
+	cacheItemMetadata := itemCache.GetMetadata()
+	imgType := item.GetMetadata().GetSubtype()
+	if !image.IsRawFormat(imgType) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s is no camera raw format", imgType)
+	}
+	format, compress, quality, depth, tile, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Get("format") == "" {
+		format = "tiff"
+	}
+	// tiff keeps the 16 bit of the development unless a depth is requested
+	if depth == image.DepthSource && strings.HasPrefix(strings.ToLower(format), "tif") {
+		depth = image.Depth16
+	}
+	if !slices.Contains(rawFormats, strings.ToLower(format)) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid format %s, allowed are %s", format, strings.Join(rawFormats, ", "))
+	}
+	metadataPolicy, err := ia.metadataPolicy(domain, params)
+	if err != nil {
+		return nil, err
+	}
+	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "rawdevelop", params.String())
+	itemImagePath := cacheItemMetadata.GetPath()
+	if !isUrlRegexp.MatchString(itemImagePath) {
+		itemImagePath = fmt.Sprintf("%s/%s", storage.GetFilebase(), strings.TrimPrefix(itemImagePath, "/"))
+	}
+	img, err := ia.decodeImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), imgType, params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	colorSpace := strings.ToLower(params.Get("rawcolor"))
+	if colorSpace == "" {
+		colorSpace = defaultColorProfile
+	}
+	// the pixels are in the raw colour space already, the transformation only embeds its profile
+	if profile, ok := ia.colorProfiles[colorSpace]; ok {
+		if err := ia.image.TransformColorProfile(img, profile, profile); err != nil && !errors.Is(err, image.ErrNotSupported) {
+			return nil, status.Errorf(codes.Internal, "cannot embed color profile %s: %v", colorSpace, err)
+		}
+	}
+	if err := ia.watermark(domain, img, params); err != nil {
+		return nil, err
+	}
+	return ia.storeImage(img, "rawdevelop", item, itemCache, storage, params, format, compress, quality, depth, tile, metadataPolicy)
+}
+
+func (ia *imageAction) region(domain string, item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
+	itemIdentifier := item.GetIdentifier()
+	cacheItemMetadata := itemCache.GetMetadata()
+	region := params.Get("region")
+	if region == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "no region defined")
+	}
+	format, compress, quality, depth, tile, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	}
+	metadataPolicy, err := ia.metadataPolicy(domain, params)
+	if err != nil {
+		return nil, err
+	}
+	var resizeType = image.ResizeTypeAspect
+	if params.Has("stretch") {
+		resizeType = image.ResizeTypeStretch
+	} else if params.Has("crop") {
+		resizeType = image.ResizeTypeCrop
+	} else if params.Has("smartcrop") {
+		resizeType = image.ResizeTypeSmartCrop
+	} else if params.Has("pad") {
+		resizeType = image.ResizeTypePad
+	}
+	anchor, err := cropAnchor(params)
+	if err != nil {
+		return nil, err
+	}
+	background, err := backgroundColor(params)
+	if err != nil {
+		return nil, err
+	}
+	upscale, err := ia.upscale(domain, params)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := image.ParseFilter(params.Get("filter"))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "region", params.String())
+	itemImagePath := cacheItemMetadata.GetPath()
+	if !isUrlRegexp.MatchString(itemImagePath) {
+		itemImagePath = fmt.Sprintf("%s/%s", storage.GetFilebase(), strings.TrimPrefix(itemImagePath, "/"))
+	}
+	img, err := ia.loadImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype(), params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	width, height := img.Dimensions()
+	x, y, w, h, err := image.ParseRegion(region, width, height)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid region %s: %v", region, err)
+	}
+	if err := ia.image.Crop(img, x, y, w, h); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot crop %s: %v", itemImagePath, err)
+	}
+	if size := params.Get("size"); size != "" {
+		size, resizeType, upscale, err = resolveSize(img, size, resizeType, upscale)
 		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "invalid quality %s", qualityStr)
+			return nil, err
 		}
-		if quality < 0 || quality > 100 {
-			return nil, status.Errorf(codes.InvalidArgument, "quality %d not >= 0 and <= 100", quality)
+		if size != "" {
+			if err := ia.image.Resize(img, size, resizeType, anchor, background, upscale, filter); err != nil {
+				return nil, status.Errorf(codes.Internal, "cannot resize %s: %v", itemImagePath, err)
+			}
 		}
 	}
-	compress := params.Get("compress")
-	tile := params.Get("tile")
-	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "convert", params.String())
+	if err := ia.rotate(img, params); err != nil {
+		return nil, err
+	}
+
+	if params.Has("blur") {
+		if err := ia.image.Blur(img, params.Get("blur")); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot blur %s: %v", itemImagePath, err)
+		}
+	}
+
+	if params.Has("sharpen") {
+		if err := ia.image.Sharpen(img, params.Get("sharpen")); err != nil {
+			return nil, status.Errorf(codes.Internal, "cannot sharpen %s: %v", itemImagePath, err)
+		}
+	}
+
+	if err := ia.watermark(domain, img, params); err != nil {
+		return nil, err
+	}
+	if err := ia.convertColorSpace(img, params); err != nil {
+		return nil, err
+	}
+	return ia.storeImage(img, "region", item, itemCache, storage, params, format, compress, quality, depth, tile, metadataPolicy)
+}
+
+// metadataDocument is the json document stored by the metadata action
+type metadataDocument struct {
+	Format     string `json:"format"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	ColorSpace string `json:"colorspace"`
+	Pages      int    `json:"pages"`
+	*image.Metadata
+}
+
+func (ia *imageAction) metadata(item *mediaserverproto.Item, itemCache *mediaserverproto.Cache, storage *mediaserverproto.Storage, params actionParams.ActionParams) (*mediaserverproto.Cache, error) {
+	itemIdentifier := item.GetIdentifier()
+	cacheItemMetadata := itemCache.GetMetadata()
+	ia.logger.Info().Msgf("action %s/%s/%s/%s", itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "metadata", params.String())
 	itemImagePath := cacheItemMetadata.GetPath()
 	if !isUrlRegexp.MatchString(itemImagePath) {
 		itemImagePath = fmt.Sprintf("%s/%s", storage.GetFilebase(), strings.TrimPrefix(itemImagePath, "/"))
 	}
-	img, err := ia.loadImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype())
+	// the master is read as it is, without orientation and color management
+	img, err := ia.decodeImage(itemImagePath, cacheItemMetadata.GetWidth(), cacheItemMetadata.GetHeight(), item.GetMetadata().GetSubtype(), params)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	metadata, err := ia.image.Metadata(img)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot read metadata of %s: %v", itemImagePath, err)
+	}
+	width, height := img.Dimensions()
+	data, err := json.MarshalIndent(metadataDocument{
+		Format:     img.Format(),
+		Width:      width,
+		Height:     height,
+		ColorSpace: img.ColorSpace(),
+		Pages:      img.Pages(),
+		Metadata:   metadata,
+	}, "", "  ")
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot marshal metadata of %s: %v", itemImagePath, err)
+	}
+
+	cacheName := actionController.CreateCacheName(itemIdentifier.GetCollection(), itemIdentifier.GetSignature(), "metadata", params.String(), "json")
+	targetPath := fmt.Sprintf(
+		"%s/%s/%s",
+		storage.GetFilebase(),
+		storage.GetDatadir(),
+		cacheName)
+	target, err := writefs.Create(ia.vFS, targetPath)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "cannot decode %s: %v", itemImagePath, err)
+		return nil, status.Errorf(codes.NotFound, "cannot open %s: %v", targetPath, err)
+	}
+	if _, err := target.Write(data); err != nil {
+		_ = target.Close()
+		return nil, status.Errorf(codes.Internal, "cannot write %s: %v", targetPath, err)
+	}
+	if err := target.Close(); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot close %s: %v", targetPath, err)
 	}
-	defer ia.image.Release(img)
-	return ia.storeImage(img, "convert", item, itemCache, storage, params, format, compress, quality, tile)
+	ia.logger.Info().Msgf("stored %s/%s", ia.vFS, targetPath)
+	return &mediaserverproto.Cache{
+		Identifier: &mediaserverproto.ItemIdentifier{
+			Collection: itemIdentifier.GetCollection(),
+			Signature:  itemIdentifier.GetSignature(),
+		},
+		Metadata: &mediaserverproto.CacheMetadata{
+			Action:   "metadata",
+			Params:   params.String(),
+			Width:    int64(width),
+			Height:   int64(height),
+			Duration: 0,
+			Size:     int64(len(data)),
+			MimeType: "application/json",
+			Path:     fmt.Sprintf("%s/%s", storage.GetDatadir(), cacheName),
+			Storage:  storage,
+		},
+	}, nil
 }
 
 func (ia *imageAction) Action(ctx context.Context, ap *mediaserverproto.ActionParam) (*mediaserverproto.Cache, error) {
@@ -334,9 +951,15 @@ func (ia *imageAction) Action(ctx context.Context, ap *mediaserverproto.ActionPa
 	action := ap.GetAction()
 	switch strings.ToLower(action) {
 	case "resize":
-		return ia.resize(item, cacheItem, storage, ap.GetParams())
+		return ia.resize(domain, item, cacheItem, storage, ap.GetParams())
 	case "convert":
-		return ia.convert(item, cacheItem, storage, ap.GetParams())
+		return ia.convert(domain, item, cacheItem, storage, ap.GetParams())
+	case "region":
+		return ia.region(domain, item, cacheItem, storage, ap.GetParams())
+	case "metadata":
+		return ia.metadata(item, cacheItem, storage, ap.GetParams())
+	case "rawdevelop":
+		return ia.rawdevelop(domain, item, cacheItem, storage, ap.GetParams())
 	default:
 		return nil, status.Errorf(codes.InvalidArgument, "no action defined")
 
@@ -0,0 +1,305 @@
+package service
+
+import (
+	"context"
+	"emperror.dev/errors"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	actionParams "go.ub.unibas.ch/mediaserver/mediaserverhelper/v2/pkg/actionParams"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/image"
+	mediaserverproto "go.ub.unibas.ch/mediaserver/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testDB answers GetCache with a master of 400x300 pixels or err
+type testDB struct {
+	mediaserverproto.DatabaseClient
+	err error
+}
+
+func (db *testDB) GetCache(_ context.Context, _ *mediaserverproto.CacheRequest, _ ...grpc.CallOption) (*mediaserverproto.Cache, error) {
+	if db.err != nil {
+		return nil, db.err
+	}
+	return &mediaserverproto.Cache{
+		Identifier: &mediaserverproto.ItemIdentifier{Collection: "test", Signature: "master"},
+		Metadata:   &mediaserverproto.CacheMetadata{Path: "master.jpg", Width: 400, Height: 300},
+	}, nil
+}
+
+func testAction() *imageAction {
+	logger := zerolog.Nop()
+	return &imageAction{
+		logger: zLogger.ZLogger(&logger),
+		vFS:    fstest.MapFS{},
+		dbs: map[string]mediaserverproto.DatabaseClient{
+			"test":   &testDB{},
+			"broken": &testDB{err: errors.New("database down")},
+		},
+		domainConfigs: map[string]DomainConfig{
+			"test": {Metadata: "keep", Upscale: true},
+		},
+	}
+}
+
+func TestActionRouting(t *testing.T) {
+	item := &mediaserverproto.Item{
+		Identifier: &mediaserverproto.ItemIdentifier{Collection: "test", Signature: "master"},
+		Metadata:   &mediaserverproto.ItemMetadata{Type: "image", Subtype: "jpeg"},
+	}
+	storage := &mediaserverproto.Storage{Name: "test", Filebase: "base", Datadir: "data"}
+	tests := []struct {
+		name     string
+		domain   string
+		param    *mediaserverproto.ActionParam
+		wantCode codes.Code
+		// wantMsg identifies the action the request was routed to
+		wantMsg string
+	}{
+		{name: "no item", domain: "test", param: &mediaserverproto.ActionParam{Action: "resize", Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no item"},
+		{name: "no storage", domain: "test", param: &mediaserverproto.ActionParam{Action: "resize", Item: item}, wantCode: codes.InvalidArgument, wantMsg: "no storage"},
+		{name: "unknown domain", domain: "other", param: &mediaserverproto.ActionParam{Action: "resize", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no database for domain other"},
+		{name: "no database", domain: "broken", param: &mediaserverproto.ActionParam{Action: "resize", Item: item, Storage: storage}, wantCode: codes.NotFound, wantMsg: "database down"},
+		{name: "unknown action", domain: "test", param: &mediaserverproto.ActionParam{Action: "explode", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no action defined"},
+		{name: "resize", domain: "test", param: &mediaserverproto.ActionParam{Action: "resize", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no size defined"},
+		{name: "resize upper case", domain: "test", param: &mediaserverproto.ActionParam{Action: "RESIZE", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no size defined"},
+		{name: "region", domain: "test", param: &mediaserverproto.ActionParam{Action: "region", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no region defined"},
+		{name: "convert", domain: "test", param: &mediaserverproto.ActionParam{Action: "convert", Item: item, Storage: storage, Params: map[string]string{"quality": "best"}}, wantCode: codes.InvalidArgument, wantMsg: "invalid quality"},
+		{name: "metadata", domain: "test", param: &mediaserverproto.ActionParam{Action: "metadata", Item: item, Storage: storage, Params: map[string]string{"page": "0"}}, wantCode: codes.InvalidArgument, wantMsg: "invalid page"},
+		{name: "rawdevelop", domain: "test", param: &mediaserverproto.ActionParam{Action: "rawdevelop", Item: item, Storage: storage}, wantCode: codes.InvalidArgument, wantMsg: "no camera raw format"},
+		{name: "master not found", domain: "test", param: &mediaserverproto.ActionParam{Action: "convert", Item: item, Storage: storage}, wantCode: codes.NotFound, wantMsg: "base/master.jpg"},
+	}
+	ia := testAction()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("domain", test.domain))
+			_, err := ia.Action(ctx, test.param)
+			if status.Code(err) != test.wantCode || !strings.Contains(err.Error(), test.wantMsg) {
+				t.Errorf("got %v, want %s with '%s'", err, test.wantCode, test.wantMsg)
+			}
+		})
+	}
+}
+
+func TestParamsListed(t *testing.T) {
+	// every action of Params is routed by Action
+	for _, action := range []string{"resize", "convert", "region", "metadata", "rawdevelop"} {
+		if _, ok := Params[action]; !ok {
+			t.Errorf("action %s is not announced", action)
+		}
+	}
+	for action, params := range Params {
+		if action != "metadata" && !strings.Contains(strings.Join(params, ","), "watermarkopacity") {
+			t.Errorf("action %s does not list the watermark parameters", action)
+		}
+	}
+}
+
+func TestNewActionServiceDomainConfig(t *testing.T) {
+	logger := zerolog.Nop()
+	colorProfiles := map[string][]byte{"srgb": []byte("icc")}
+	tests := map[string]struct {
+		colorProfiles map[string][]byte
+		domains       map[string]DomainConfig
+	}{
+		"no srgb profile":   {colorProfiles: map[string][]byte{}},
+		"invalid metadata":  {colorProfiles: colorProfiles, domains: map[string]DomainConfig{"test": {Metadata: "some"}}},
+		"unknown watermark": {colorProfiles: colorProfiles, domains: map[string]DomainConfig{"test": {Watermark: "logo"}}},
+	}
+	for name, test := range tests {
+		if _, err := NewActionService(nil, "test", nil, 1, 1, time.Second, fstest.MapFS{}, nil, test.colorProfiles, test.domains, nil, "", zLogger.ZLogger(&logger)); err == nil {
+			t.Errorf("%s: service created", name)
+		}
+	}
+}
+
+func TestDomainDefaults(t *testing.T) {
+	ia := testAction()
+	policy, err := ia.metadataPolicy("test", actionParams.ActionParams{})
+	if err != nil || policy != image.MetadataKeep {
+		t.Errorf("domain default: got %v (%v), want keep", policy, err)
+	}
+	policy, err = ia.metadataPolicy("other", actionParams.ActionParams{})
+	if err != nil || policy != defaultMetadataPolicy {
+		t.Errorf("service default: got %v (%v), want %v", policy, err, defaultMetadataPolicy)
+	}
+	policy, err = ia.metadataPolicy("test", actionParams.ActionParams{"metadata": "strip"})
+	if err != nil || policy != image.MetadataStrip {
+		t.Errorf("parameter: got %v (%v), want strip", policy, err)
+	}
+	if _, err := ia.metadataPolicy("test", actionParams.ActionParams{"metadata": "some"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid metadata: got %v", err)
+	}
+
+	upscaleTests := []struct {
+		domain string
+		params actionParams.ActionParams
+		want   bool
+	}{
+		{domain: "test", params: actionParams.ActionParams{}, want: true},
+		{domain: "other", params: actionParams.ActionParams{}, want: false},
+		{domain: "other", params: actionParams.ActionParams{"upscale": ""}, want: true},
+		{domain: "test", params: actionParams.ActionParams{"upscale": "false"}, want: false},
+	}
+	for _, test := range upscaleTests {
+		if upscale, err := ia.upscale(test.domain, test.params); err != nil || upscale != test.want {
+			t.Errorf("%s %v: got %v (%v), want %v", test.domain, test.params, upscale, err, test.want)
+		}
+	}
+	if _, err := ia.upscale("test", actionParams.ActionParams{"upscale": "maybe"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("invalid upscale: got %v", err)
+	}
+}
+
+// sizedImage is an image of a given size for resolveSize
+type sizedImage struct {
+	width, height int
+}
+
+func (img sizedImage) Dimensions() (int, int) { return img.width, img.height }
+func (sizedImage) Format() string             { return "png" }
+func (sizedImage) ColorSpace() string         { return "srgb" }
+func (sizedImage) Pages() int                 { return 1 }
+func (sizedImage) Close() error               { return nil }
+
+func TestResolveSize(t *testing.T) {
+	img := sizedImage{width: 400, height: 300}
+	tests := []struct {
+		size        string
+		resizeType  image.ResizeType
+		upscale     bool
+		want        string
+		wantType    image.ResizeType
+		wantUpscale bool
+		wantErr     bool
+	}{
+		{size: "max", want: "", wantType: image.ResizeTypeStretch},
+		{size: "200,", want: "200x150", wantType: image.ResizeTypeStretch},
+		{size: ",150", want: "200x150", wantType: image.ResizeTypeStretch},
+		{size: "pct:50", want: "200x150", wantType: image.ResizeTypeStretch},
+		{size: "!100,100", want: "100x75", wantType: image.ResizeTypeStretch},
+		{size: "100,100", resizeType: image.ResizeTypeCrop, want: "100x100", wantType: image.ResizeTypeCrop},
+		{size: "400,300", resizeType: image.ResizeTypeCrop, want: "400x300", wantType: image.ResizeTypeCrop},
+		{size: "800,", wantErr: true},
+		{size: "^800,", want: "800x600", wantType: image.ResizeTypeStretch, wantUpscale: true},
+		{size: "800,", upscale: true, want: "800x600", wantType: image.ResizeTypeStretch, wantUpscale: true},
+		// the legacy syntax is passed to the backend as it is
+		{size: "200x0", want: "200x0", wantType: image.ResizeTypeAspect},
+		{size: "0,", wantErr: true},
+		{size: "99999999999999999999,", wantErr: true},
+		{size: ",99999999999999999999", wantErr: true},
+		{size: "big", wantErr: true},
+	}
+	for _, test := range tests {
+		got, resizeType, upscale, err := resolveSize(img, test.size, test.resizeType, test.upscale)
+		if test.wantErr {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s: got %s (%v), want InvalidArgument", test.size, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.size, err)
+			continue
+		}
+		if got != test.want || resizeType != test.wantType || upscale != test.wantUpscale {
+			t.Errorf("%s: got '%s' %v %v, want '%s' %v %v", test.size, got, resizeType, upscale, test.want, test.wantType, test.wantUpscale)
+		}
+	}
+}
+
+func TestPageIndex(t *testing.T) {
+	tests := []struct {
+		imgType string
+		params  actionParams.ActionParams
+		want    int
+		wantErr bool
+	}{
+		{imgType: "tiff", params: actionParams.ActionParams{}, want: 0},
+		{imgType: "tiff", params: actionParams.ActionParams{"page": "3"}, want: 2},
+		{imgType: "gif", params: actionParams.ActionParams{"frame": "2"}, want: 1},
+		{imgType: "gif", params: actionParams.ActionParams{"format": "webp"}, want: image.AllPages},
+		{imgType: "gif", params: actionParams.ActionParams{"format": "png"}, want: 0},
+		{imgType: "tiff", params: actionParams.ActionParams{"page": "0"}, wantErr: true},
+		{imgType: "tiff", params: actionParams.ActionParams{"page": "one"}, wantErr: true},
+	}
+	for _, test := range tests {
+		page, err := pageIndex(test.imgType, test.params)
+		if test.wantErr {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s %v: got %d (%v), want InvalidArgument", test.imgType, test.params, page, err)
+			}
+			continue
+		}
+		if err != nil || page != test.want {
+			t.Errorf("%s %v: got %d (%v), want %d", test.imgType, test.params, page, err, test.want)
+		}
+	}
+}
+
+func TestDensity(t *testing.T) {
+	tests := map[string]struct {
+		params  actionParams.ActionParams
+		want    int
+		wantErr bool
+	}{
+		"unset":    {params: actionParams.ActionParams{}, want: 0},
+		"density":  {params: actionParams.ActionParams{"density": "300"}, want: 300},
+		"dpi":      {params: actionParams.ActionParams{"dpi": "150"}, want: 150},
+		"maximum":  {params: actionParams.ActionParams{"dpi": "1200"}, want: 1200},
+		"too high": {params: actionParams.ActionParams{"density": "1201"}, wantErr: true},
+		"zero":     {params: actionParams.ActionParams{"density": "0"}, wantErr: true},
+		"invalid":  {params: actionParams.ActionParams{"dpi": "high"}, wantErr: true},
+	}
+	for name, test := range tests {
+		dpi, err := density(test.params)
+		if test.wantErr {
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("%s: got %d (%v), want InvalidArgument", name, dpi, err)
+			}
+			continue
+		}
+		if err != nil || dpi != test.want {
+			t.Errorf("%s: got %d (%v), want %d", name, dpi, err, test.want)
+		}
+	}
+}
+
+func TestRawOptions(t *testing.T) {
+	whiteBalance, demosaic, colorSpace, err := rawOptions(actionParams.ActionParams{"whitebalance": "auto", "demosaic": "dcb", "rawcolor": "prophoto"})
+	if err != nil || whiteBalance != image.WhiteBalanceAuto || demosaic != image.DemosaicDCB || colorSpace != image.RawColorSpaceProPhoto {
+		t.Errorf("got %v %v %v (%v)", whiteBalance, demosaic, colorSpace, err)
+	}
+	for _, name := range []string{"whitebalance", "demosaic", "rawcolor"} {
+		if _, _, _, err := rawOptions(actionParams.ActionParams{name: "foo"}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("invalid %s: got %v", name, err)
+		}
+	}
+}
+
+func TestEncodeParams(t *testing.T) {
+	format, compress, quality, depth, tile, err := encodeParams(actionParams.ActionParams{})
+	if err != nil || format != "jpeg" || compress != "" || quality != 100 || depth != image.DepthSource || tile != "" {
+		t.Errorf("defaults: got %s %s %d %v %s (%v)", format, compress, quality, depth, tile, err)
+	}
+	format, compress, quality, depth, tile, err = encodeParams(actionParams.ActionParams{"format": "tiff", "compress": "lzw", "quality": "80", "depth": "16", "tile": "256x256"})
+	if err != nil || format != "tiff" || compress != "lzw" || quality != 80 || depth != image.Depth16 || tile != "256x256" {
+		t.Errorf("got %s %s %d %v %s (%v)", format, compress, quality, depth, tile, err)
+	}
+	for name, params := range map[string]actionParams.ActionParams{
+		"invalid quality":  {"quality": "good"},
+		"quality too high": {"quality": "101"},
+		"invalid depth":    {"depth": "12"},
+	} {
+		if _, _, _, _, _, err := encodeParams(params); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bytes"
+	"emperror.dev/errors"
+	"fmt"
+	actionParams "go.ub.unibas.ch/mediaserver/mediaserverhelper/v2/pkg/actionParams"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/image"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"image/color"
+	"io/fs"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WatermarkConfig describes an overlay which is composited onto derivatives
+type WatermarkConfig struct {
+	// Path is the vfs path of a png or svg file
+	Path string `toml:"path"`
+	// Gravity anchors the overlay, center if empty
+	Gravity string `toml:"gravity"`
+	// Position is the top left corner ("x,y") and replaces gravity and margin
+	Position string `toml:"position"`
+	// Margin is the distance in pixels to the edges the overlay is anchored to
+	Margin int `toml:"margin"`
+	// Opacity scales the alpha of the overlay, 0 is taken as 1
+	Opacity float64 `toml:"opacity"`
+	// Scale fits the overlay into this fraction of the output size, 0 keeps its size
+	Scale float64 `toml:"scale"`
+}
+
+// watermark is a configured overlay with its file content
+type watermark struct {
+	WatermarkConfig
+	name   string
+	data   []byte
+	format string
+}
+
+var positionRegexp = regexp.MustCompile(`^(-?\d+),(-?\d+)$`)
+
+// loadWatermarks reads the overlay files of the watermarks
+func loadWatermarks(vfs fs.FS, watermarkConfigs map[string]WatermarkConfig) (map[string]*watermark, error) {
+	watermarks := map[string]*watermark{}
+	for name, conf := range watermarkConfigs {
+		if _, err := image.ParseGravity(conf.Gravity); err != nil {
+			return nil, errors.Wrapf(err, "invalid watermark %s", name)
+		}
+		if conf.Position != "" && !positionRegexp.MatchString(conf.Position) {
+			return nil, errors.Errorf("invalid position '%s' of watermark %s", conf.Position, name)
+		}
+		data, err := fs.ReadFile(vfs, conf.Path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read watermark %s from %s", name, conf.Path)
+		}
+		watermarks[name] = &watermark{
+			WatermarkConfig: conf,
+			name:            name,
+			data:            data,
+			format:          strings.TrimPrefix(strings.ToLower(path.Ext(conf.Path)), "."),
+		}
+	}
+	return watermarks, nil
+}
+
+// watermarkParams are the parameters which select or place a watermark
+var watermarkParams = []string{"watermark", "watermarkgravity", "watermarkposition", "watermarkmargin", "watermarkopacity", "watermarkscale"}
+
+// watermarkConfig returns the watermark of the parameter or the default of the domain, nil if there is none.
+// The parameters watermarkgravity, watermarkposition, watermarkmargin, watermarkopacity and
+// watermarkscale override the configuration, domains with a watermark reject all watermark parameters.
+func (ia *imageAction) watermarkConfig(domain string, params actionParams.ActionParams) (*watermark, WatermarkConfig, error) {
+	if domainWatermark := ia.domainConfigs[domain].Watermark; domainWatermark != "" {
+		// rights holders require the watermark of the domain as configured, it cannot be replaced, moved or faded
+		for _, param := range watermarkParams {
+			if params.Has(param) {
+				return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "parameter %s not allowed, domain %s has a fixed watermark", param, domain)
+			}
+		}
+		wm, ok := ia.watermarks[domainWatermark]
+		if !ok {
+			return nil, WatermarkConfig{}, status.Errorf(codes.Internal, "unknown watermark %s of domain %s", domainWatermark, domain)
+		}
+		conf := wm.WatermarkConfig
+		if conf.Opacity == 0 {
+			conf.Opacity = 1
+		}
+		return wm, conf, nil
+	}
+	name := params.Get("watermark")
+	if name == "" && params.Has("watermark") {
+		name = "default"
+	}
+	if name == "" || name == "none" {
+		return nil, WatermarkConfig{}, nil
+	}
+	wm, ok := ia.watermarks[name]
+	if !ok {
+		return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "unknown watermark %s", name)
+	}
+	conf := wm.WatermarkConfig
+	if params.Has("watermarkgravity") {
+		conf.Gravity = params.Get("watermarkgravity")
+	}
+	if params.Has("watermarkposition") {
+		conf.Position = params.Get("watermarkposition")
+	}
+	var err error
+	if str := params.Get("watermarkmargin"); str != "" {
+		if conf.Margin, err = strconv.Atoi(str); err != nil || conf.Margin < 0 {
+			return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "invalid watermark margin %s", str)
+		}
+	}
+	if str := params.Get("watermarkopacity"); str != "" {
+		if conf.Opacity, err = strconv.ParseFloat(str, 64); err != nil {
+			return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "invalid watermark opacity %s", str)
+		}
+	}
+	if str := params.Get("watermarkscale"); str != "" {
+		if conf.Scale, err = strconv.ParseFloat(str, 64); err != nil {
+			return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "invalid watermark scale %s", str)
+		}
+	}
+	if conf.Opacity == 0 {
+		conf.Opacity = 1
+	}
+	if math.IsNaN(conf.Opacity) || math.IsInf(conf.Opacity, 0) || conf.Opacity < 0 || conf.Opacity > 1 {
+		return nil, WatermarkConfig{}, status.Errorf(codes.InvalidArgument, "watermark opacity %v not > 0 and <= 1", conf.Opacity)
+	}
+	return wm, conf, nil
+}
+
+// watermark composites the watermark selected by watermarkConfig onto img
+func (ia *imageAction) watermark(domain string, img image.Image, params actionParams.ActionParams) error {
+	wm, conf, err := ia.watermarkConfig(domain, params)
+	if err != nil || wm == nil {
+		return err
+	}
+	name := wm.name
+	gravity, err := image.ParseGravity(conf.Gravity)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	overlay, err := ia.image.Decode(bytes.NewReader(wm.data), 0, 0, wm.format, 0, 0)
+	if err != nil {
+		if errors.Is(err, image.ErrNotSupported) {
+			return status.Errorf(codes.Unimplemented, "cannot decode watermark %s: %v", name, err)
+		}
+		return status.Errorf(codes.Internal, "cannot decode watermark %s: %v", name, err)
+	}
+	defer overlay.Close()
+	width, height := img.Dimensions()
+	overlayWidth, overlayHeight := overlay.Dimensions()
+	scaledWidth, scaledHeight, err := image.OverlaySize(width, height, overlayWidth, overlayHeight, conf.Scale)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "watermark %s: %v", name, err)
+	}
+	if scaledWidth != overlayWidth || scaledHeight != overlayHeight {
+		if err := ia.image.Resize(overlay, fmt.Sprintf("%dx%d", scaledWidth, scaledHeight), image.ResizeTypeStretch, image.CropAnchor{}, color.NRGBA{}, true, image.FilterLanczos); err != nil {
+			return status.Errorf(codes.Internal, "cannot scale watermark %s: %v", name, err)
+		}
+	}
+	x, y := gravity.Position(width, height, scaledWidth, scaledHeight, conf.Margin)
+	if conf.Position != "" {
+		parts := positionRegexp.FindStringSubmatch(conf.Position)
+		if parts == nil {
+			return status.Errorf(codes.InvalidArgument, "invalid watermark position %s", conf.Position)
+		}
+		x, _ = strconv.Atoi(parts[1])
+		y, _ = strconv.Atoi(parts[2])
+	}
+	if err := ia.image.Composite(img, overlay, x, y, conf.Opacity); err != nil {
+		return status.Errorf(codes.Internal, "cannot composite watermark %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"emperror.dev/errors"
+	"github.com/je4/utils/v2/pkg/zLogger"
+	"github.com/rs/zerolog"
+	actionParams "go.ub.unibas.ch/mediaserver/mediaserverhelper/v2/pkg/actionParams"
+	"go.ub.unibas.ch/mediaserver/mediaserverimage/v2/pkg/image"
+	mediaserverproto "go.ub.unibas.ch/mediaserver/mediaserverproto/v2/pkg/mediaserver/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"image/color"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func testWatermarkAction() *imageAction {
+	return &imageAction{
+		domainConfigs: map[string]DomainConfig{
+			"protected": {Watermark: "logo"},
+			"open":      {},
+		},
+		watermarks: map[string]*watermark{
+			"logo":    {name: "logo", WatermarkConfig: WatermarkConfig{Gravity: "southeast", Margin: 10, Opacity: 0.5, Scale: 0.2}},
+			"default": {name: "default", WatermarkConfig: WatermarkConfig{Gravity: "center"}},
+		},
+	}
+}
+
+func TestWatermarkConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   string
+		params   actionParams.ActionParams
+		want     string
+		wantConf WatermarkConfig
+		wantCode codes.Code
+	}{
+		{name: "domain watermark", domain: "protected", params: actionParams.ActionParams{},
+			want: "logo", wantConf: WatermarkConfig{Gravity: "southeast", Margin: 10, Opacity: 0.5, Scale: 0.2}},
+		{name: "domain watermark disabled", domain: "protected", params: actionParams.ActionParams{"watermark": "none"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark replaced", domain: "protected", params: actionParams.ActionParams{"watermark": "default"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark named", domain: "protected", params: actionParams.ActionParams{"watermark": "logo"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark faded", domain: "protected", params: actionParams.ActionParams{"watermarkopacity": "0.01"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark shrunk", domain: "protected", params: actionParams.ActionParams{"watermarkscale": "0.001"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark moved", domain: "protected", params: actionParams.ActionParams{"watermarkposition": "-1000,-1000"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark gravity", domain: "protected", params: actionParams.ActionParams{"watermarkgravity": "north"}, wantCode: codes.InvalidArgument},
+		{name: "domain watermark margin", domain: "protected", params: actionParams.ActionParams{"watermarkmargin": "0"}, wantCode: codes.InvalidArgument},
+		{name: "no watermark", domain: "open", params: actionParams.ActionParams{}},
+		{name: "none", domain: "open", params: actionParams.ActionParams{"watermark": "none"}},
+		{name: "default", domain: "open", params: actionParams.ActionParams{"watermark": ""},
+			want: "default", wantConf: WatermarkConfig{Gravity: "center", Opacity: 1}},
+		{name: "overridden", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "0.25", "watermarkgravity": "north", "watermarkmargin": "3", "watermarkscale": "0.5"},
+			want: "logo", wantConf: WatermarkConfig{Gravity: "north", Margin: 3, Opacity: 0.25, Scale: 0.5}},
+		{name: "unknown domain", domain: "other", params: actionParams.ActionParams{"watermark": "logo"},
+			want: "logo", wantConf: WatermarkConfig{Gravity: "southeast", Margin: 10, Opacity: 0.5, Scale: 0.2}},
+		{name: "unknown watermark", domain: "open", params: actionParams.ActionParams{"watermark": "foo"}, wantCode: codes.InvalidArgument},
+		{name: "opacity too large", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "2"}, wantCode: codes.InvalidArgument},
+		{name: "nan opacity", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "NaN"}, wantCode: codes.InvalidArgument},
+		{name: "infinite opacity", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "+Inf"}, wantCode: codes.InvalidArgument},
+		{name: "negative infinite opacity", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "-Inf"}, wantCode: codes.InvalidArgument},
+		{name: "invalid opacity", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkopacity": "x"}, wantCode: codes.InvalidArgument},
+		{name: "negative margin", domain: "open", params: actionParams.ActionParams{"watermark": "logo", "watermarkmargin": "-1"}, wantCode: codes.InvalidArgument},
+	}
+	ia := testWatermarkAction()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wm, conf, err := ia.watermarkConfig(test.domain, test.params)
+			if test.wantCode != codes.OK {
+				if status.Code(err) != test.wantCode {
+					t.Fatalf("got %v, want code %s", err, test.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.want == "" {
+				if wm != nil {
+					t.Fatalf("got watermark %s, want none", wm.name)
+				}
+				return
+			}
+			if wm == nil || wm.name != test.want {
+				t.Fatalf("got watermark %v, want %s", wm, test.want)
+			}
+			if conf != test.wantConf {
+				t.Errorf("got %+v, want %+v", conf, test.wantConf)
+			}
+		})
+	}
+}
+
+// compositeHandler develops every raw master to a 400x300 image and fails to composite
+type compositeHandler struct {
+	image.ImageHandler
+}
+
+func (compositeHandler) DecodeRaw(io.Reader, string, image.WhiteBalance, image.Demosaic, image.RawColorSpace) (image.Image, error) {
+	return sizedImage{width: 400, height: 300}, nil
+}
+
+func (compositeHandler) Decode(io.Reader, int64, int64, string, int, int) (image.Image, error) {
+	return sizedImage{width: 80, height: 60}, nil
+}
+
+func (compositeHandler) Resize(image.Image, string, image.ResizeType, image.CropAnchor, color.NRGBA, bool, image.Filter) error {
+	return nil
+}
+
+func (compositeHandler) Composite(image.Image, image.Image, int, int, float64) error {
+	return errors.New("composited")
+}
+
+func TestRawdevelopWatermark(t *testing.T) {
+	// the development of a domain with a fixed watermark is watermarked like any other derivative
+	logger := zerolog.Nop()
+	ia := testWatermarkAction()
+	ia.logger = zLogger.ZLogger(&logger)
+	ia.vFS = fstest.MapFS{"base/master.cr2": {Data: []byte("raw")}}
+	ia.image = compositeHandler{}
+	item := &mediaserverproto.Item{
+		Identifier: &mediaserverproto.ItemIdentifier{Collection: "test", Signature: "master"},
+		Metadata:   &mediaserverproto.ItemMetadata{Type: "image", Subtype: "cr2"},
+	}
+	itemCache := &mediaserverproto.Cache{Metadata: &mediaserverproto.CacheMetadata{Path: "master.cr2", Width: 400, Height: 300}}
+	storage := &mediaserverproto.Storage{Name: "test", Filebase: "base", Datadir: "data"}
+	tests := []struct {
+		domain   string
+		params   actionParams.ActionParams
+		wantCode codes.Code
+		wantMsg  string
+	}{
+		{domain: "protected", params: actionParams.ActionParams{}, wantCode: codes.Internal, wantMsg: "cannot composite watermark logo"},
+		{domain: "protected", params: actionParams.ActionParams{"watermark": "none"}, wantCode: codes.InvalidArgument, wantMsg: "fixed watermark"},
+		{domain: "open", params: actionParams.ActionParams{"watermark": ""}, wantCode: codes.Internal, wantMsg: "cannot composite watermark default"},
+	}
+	for _, test := range tests {
+		_, err := ia.rawdevelop(test.domain, item, itemCache, storage, test.params)
+		if status.Code(err) != test.wantCode || !strings.Contains(status.Convert(err).Message(), test.wantMsg) {
+			t.Errorf("%s %v: got %v, want %v %s", test.domain, test.params, err, test.wantCode, test.wantMsg)
+		}
+	}
+}
+
+func TestLoadWatermarks(t *testing.T) {
+	vfs := fstest.MapFS{"wm/logo.PNG": {Data: []byte("png")}}
+	watermarks, err := loadWatermarks(vfs, map[string]WatermarkConfig{"logo": {Path: "wm/logo.PNG", Gravity: "south"}})
+	if err != nil {
+		t.Fatalf("cannot load watermarks: %v", err)
+	}
+	if wm := watermarks["logo"]; wm == nil || wm.name != "logo" || wm.format != "png" || string(wm.data) != "png" {
+		t.Errorf("unexpected watermark %+v", wm)
+	}
+	for name, conf := range map[string]WatermarkConfig{
+		"missing file":     {Path: "wm/none.png"},
+		"invalid gravity":  {Path: "wm/logo.PNG", Gravity: "up"},
+		"invalid position": {Path: "wm/logo.PNG", Position: "1;2"},
+	} {
+		if _, err := loadWatermarks(vfs, map[string]WatermarkConfig{"logo": conf}); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}